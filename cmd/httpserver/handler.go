@@ -2,104 +2,131 @@ package main
 
 import (
 	"crypto/sha256"
-	"fmt"
-	"net/http"
+	"hash"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
-	"strings"
 
+	"github.com/AmiyoKm/httpfromtcp/internal/compress"
 	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/middleware"
+	"github.com/AmiyoKm/httpfromtcp/internal/proxy"
 	"github.com/AmiyoKm/httpfromtcp/internal/request"
 	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/router"
 	"github.com/AmiyoKm/httpfromtcp/internal/server"
 )
 
-var handler = server.Handler(func(w *response.Writer, r *request.Request) {
-	h := response.GetDefaultHeaders(0)
-	h.Replace("Content-Type", "text/html")
-	if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin/stream") {
-		target := r.RequestLine.RequestTarget
-		res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
-		if err != nil {
-			body := respond500()
-
-			w.WriteStatusLine(response.StatusInternalServerError)
-			h.Replace("Content-Length", strconv.Itoa(len(body)))
-			w.WriteHeaders(*h)
-			w.WriteBody(body)
-			return
-		}
-		w.WriteStatusLine(response.StatusOK)
-
-		h.Delete("Content-Length")
-		h.Set("transfer-encoding", "chunked")
-		h.Replace("Content-Type", "text/plain")
-		h.Set("Trailer", "X-Content-SHA256")
-		h.Set("Trailer", "X-Content-Length")
-		w.WriteHeaders(*h)
-
-		fullBody := []byte{}
-		for {
-			data := make([]byte, 32)
-			n, err := res.Body.Read(data)
-			if err != nil {
-				break
-			}
-
-			fullBody = append(fullBody, data[:n]...)
-			w.WriteChunkedBody(data[:n])
-		}
-
-		w.WriteChunkedBodyDone()
-
-		trailers := headers.NewHeaders()
-		encrypted := sha256.Sum256(fullBody)
-		trailers.Set("X-Content-SHA256", toStr(encrypted[:]))
-		trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-
-		w.WriteHeaders(*trailers)
-
-		return
+func newRouter() *router.Router {
+	r := router.New()
+	r.Use(
+		middleware.Logger(slog.Default()),
+		compress.Middleware(compress.Options{}),
+		compress.DecodeRequest(maxDecodedBody),
+	)
+	r.Handle("/httpbin/stream/{n}", httpbinStream().Serve)
+	r.Handle("/yourproblem", handleYourProblem)
+	r.Handle("/myproblem", handleMyProblem)
+	r.Handle("/video", handleVideo)
+	r.Handle("/{path...}", handleIndex)
+	return r
+}
+
+var handler = server.Handler(newRouter().Serve)
+
+// httpbinStream forwards /httpbin/stream/{n} to httpbin.org and follows the
+// relayed body with checksum trailers
+func httpbinStream() *proxy.ReverseProxy {
+	p, err := proxy.New("https://httpbin.org")
+	if err != nil {
+		panic(err)
 	}
+	p.StripPrefix = "/httpbin"
+	p.ModifyResponse = addChecksumTrailers
+	return p
+}
+
+// addChecksumTrailers announces the X-Content-SHA256 and X-Content-Length
+// trailers and fills them in once the body has been read. Trailers need a
+// chunked body, so the upstream Content-Length is dropped.
+func addChecksumTrailers(res *response.Response) error {
+	res.Headers.Delete("Content-Length")
+	res.Headers.Set("Trailer", "X-Content-SHA256")
+	res.Headers.Set("Trailer", "X-Content-Length")
+	res.Body = &checksumBody{ReadCloser: res.Body, hash: sha256.New(), trailers: res.Trailers}
+	return nil
+}
+
+// checksumBody hashes what is read through it and records the result in
+// trailers at EOF
+type checksumBody struct {
+	io.ReadCloser
+	hash     hash.Hash
+	length   int
+	trailers *headers.Headers
+}
+
+func (b *checksumBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	b.length += n
+	if err == io.EOF {
+		b.trailers.Replace("X-Content-SHA256", toStr(b.hash.Sum(nil)))
+		b.trailers.Replace("X-Content-Length", strconv.Itoa(b.length))
+	}
+	return n, err
+}
 
-	switch r.RequestLine.RequestTarget {
-	case "/yourproblem":
-		body := respond400()
-		w.WriteStatusLine(response.StatusBadRequest)
-		h.Replace("Content-Length", strconv.Itoa(len(body)))
-		w.WriteHeaders(*h)
-		w.WriteBody(body)
-	case "/myproblem":
-		body := respond500()
-
+func htmlHeaders() *headers.Headers {
+	h := response.GetDefaultHeaders(0)
+	h.Replace("Content-Type", "text/html")
+	return h
+}
+
+func handleYourProblem(w *response.Writer, r *request.Request) {
+	h := htmlHeaders()
+	body := respond400()
+	w.WriteStatusLine(response.StatusBadRequest)
+	h.Replace("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func handleMyProblem(w *response.Writer, r *request.Request) {
+	h := htmlHeaders()
+	body := respond500()
+
+	w.WriteStatusLine(response.StatusInternalServerError)
+	h.Replace("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func handleVideo(w *response.Writer, r *request.Request) {
+	h := htmlHeaders()
+	body, err := os.ReadFile("assets/vim.mp4")
+	if err != nil {
+		body = respond500()
 		w.WriteStatusLine(response.StatusInternalServerError)
-		h.Replace("Content-Length", strconv.Itoa(len(body)))
 		w.WriteHeaders(*h)
-		w.WriteBody(body)
-
-	case "/video":
-
-		body, err := os.ReadFile("assets/vim.mp4")
-		if err != nil {
-			body = respond500()
-			w.WriteStatusLine(response.StatusInternalServerError)
-			w.WriteHeaders(*h)
-			h.Replace("Content-Length", strconv.Itoa(len(body)))
-			w.WriteBody(body)
-			return
-		}
-
-		w.WriteStatusLine(response.StatusOK)
-		h.Replace("Content-Type", "video/mp4")
 		h.Replace("Content-Length", strconv.Itoa(len(body)))
-		w.WriteHeaders(*h)
-		w.WriteBody(body)
-
-	default:
-		body := respond200()
-		w.WriteStatusLine(response.StatusOK)
-		h.Replace("Content-Length", strconv.Itoa(len(body)))
-		w.WriteHeaders(*h)
 		w.WriteBody(body)
+		return
 	}
-})
+
+	w.WriteStatusLine(response.StatusOK)
+	h.Replace("Content-Type", "video/mp4")
+	h.Replace("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func handleIndex(w *response.Writer, r *request.Request) {
+	h := htmlHeaders()
+	body := respond200()
+	w.WriteStatusLine(response.StatusOK)
+	h.Replace("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
@@ -1,26 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/AmiyoKm/httpfromtcp/internal/server"
 )
 
 const port = 42069
 
+// shutdownTimeout is how long in-flight requests get to finish on SIGTERM
+const shutdownTimeout = 30 * time.Second
+
+// maxDecodedBody caps the size of request bodies after Content-Encoding is undone
+const maxDecodedBody = 10 << 20
+
 func main() {
-	server, err := server.Serve(port, handler)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	srv := &server.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: server.DefaultReadHeaderTimeout,
+		ReadTimeout:       server.DefaultReadTimeout,
+		WriteTimeout:      server.DefaultWriteTimeout,
+		IdleTimeout:       server.DefaultIdleTimeout,
+		MaxBodyBytes:      maxDecodedBody,
+		EnableHTTP2:       true,
 	}
-	defer server.Close()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, server.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	dropped, err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Shutdown timed out, dropped %d connections: %v", dropped, err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,499 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+)
+
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 4
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxRedirects        = 10
+)
+
+// maxDrainBytes is how much of a redirect's body is read so that its
+// connection can be reused
+const maxDrainBytes = 4 << 10
+
+var ErrorMalformedResponse = response.ErrorMalformedResponse
+var ErrorUnsupportedURL = fmt.Errorf("unsupported url")
+var ErrorBodyClosed = fmt.Errorf("read on closed response body")
+var ErrorTooManyRedirects = fmt.Errorf("too many redirects")
+
+// Client sends requests over HTTP/1.1 and keeps connections open for
+// reuse, pooled per scheme and host. The zero value is ready to use. A
+// Client must not be copied after first use.
+type Client struct {
+	// Timeout bounds a whole exchange, from dialing to the end of the
+	// response body. Zero means no limit other than the request's context.
+	Timeout time.Duration
+	// DialTimeout bounds connecting, DefaultDialTimeout when zero
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for the response head once the
+	// request has been sent
+	ResponseHeaderTimeout time.Duration
+	// Dial opens connections in place of a net.Dialer with DialTimeout.
+	// TLS is layered on top for https URLs.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSConfig is used for https URLs
+	TLSConfig *tls.Config
+
+	// DisableKeepAlives sends every request with "Connection: close" and
+	// uses each connection once
+	DisableKeepAlives bool
+	// MaxIdleConns caps idle connections across all hosts,
+	// DefaultMaxIdleConns when zero
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps idle connections to one host,
+	// DefaultMaxIdleConnsPerHost when zero
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections to one host, busy and idle
+	// alike. Requests over the limit wait for a connection to free up.
+	// Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long a connection may sit idle before it is
+	// closed, DefaultIdleConnTimeout when zero
+	IdleConnTimeout time.Duration
+
+	// MaxRedirects is how many redirects Do follows before it gives up
+	// with ErrorTooManyRedirects, DefaultMaxRedirects when zero. A negative
+	// value turns following off and Do returns redirects as they are.
+	MaxRedirects int
+	// Jar, when set, keeps the cookies responses set and adds them to the
+	// requests they apply to
+	Jar *Jar
+
+	pool pool
+}
+
+var DefaultClient = &Client{}
+
+// NewRequest returns a request for rawURL, an absolute http or https URL.
+// The request target is kept in absolute form; Do sends the origin form.
+func NewRequest(ctx context.Context, method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req := request.NewRequest()
+	req.RequestLine = request.RequestLine{Method: method, RequestTarget: u.String(), HttpVersion: "1.1"}
+	req.Headers.Set("Host", u.Host)
+	if body != nil {
+		req.Body = body
+	}
+	return req.WithContext(ctx), nil
+}
+
+func parseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", ErrorUnsupportedURL, rawURL)
+	}
+	return u, nil
+}
+
+// Get fetches url with the default client
+func Get(ctx context.Context, url string) (*response.Response, error) {
+	return DefaultClient.Get(ctx, url)
+}
+
+func (c *Client) Get(ctx context.Context, url string) (*response.Response, error) {
+	req, err := NewRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req, whose target must be in absolute form, and returns the
+// response as soon as its head has arrived. The caller must close the
+// body; the connection goes back to the pool only once the body has been
+// read to the end. When the request's context ends or Timeout passes, the
+// exchange is abandoned and reads from the body fail with the context's
+// cause.
+//
+// Redirects are followed up to MaxRedirects hops. A 303, or a 301 or 302
+// answering a POST, turns the next request into a bodyless GET; 307 and
+// 308 repeat the method and body. Authorization and Cookie headers set on
+// req are dropped once a redirect leads to another host.
+//
+// An idempotent request that fails on a reused connection before any of
+// the response arrived is sent once more on a fresh connection, since the
+// server may have closed the idle connection as the request went out.
+func (c *Client) Do(req *request.Request) (*response.Response, error) {
+	return c.do(req, true)
+}
+
+// RoundTrip sends req like Do but returns the first response that comes
+// back, redirects included, and leaves the jar alone. Proxies use it to
+// pass responses on as they are.
+func (c *Client) RoundTrip(req *request.Request) (*response.Response, error) {
+	return c.do(req, false)
+}
+
+// do sends req, following redirects and using the jar when follow is set
+func (c *Client) do(req *request.Request, follow bool) (*response.Response, error) {
+	jar := c.Jar
+	if !follow {
+		jar = nil
+	}
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	for hops := 0; ; hops++ {
+		res, err := c.send(ctx, cancel, req, jar)
+		if err != nil {
+			cancel()
+			return nil, contextError(ctx, err)
+		}
+		if !follow {
+			return res, nil
+		}
+		next, err := c.redirect(req, res, hops)
+		if next == nil && err == nil {
+			return res, nil
+		}
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+
+		// the exchange goes on, so the body must not end it
+		body := res.Body.(*bodyReader)
+		body.cancel = nil
+		io.CopyN(io.Discard, body, maxDrainBytes)
+		body.Close()
+		req = next
+	}
+}
+
+// send carries out a single exchange, retrying it as Do describes. Cookies
+// come from and go to jar when it is not nil.
+func (c *Client) send(ctx context.Context, cancel context.CancelFunc, req *request.Request, jar *Jar) (*response.Response, error) {
+	target, err := parseURL(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	for retried := false; ; retried = true {
+		pc, err := c.getConn(ctx, target, retried)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(ctx, cancel, pc, req, target, jar)
+		if err == nil {
+			if jar != nil {
+				storeCookies(jar, target, res)
+			}
+			return res, nil
+		}
+		if !retried && pc.reused && pc.nread == pc.mark && Idempotent(req.RequestLine.Method) && ctx.Err() == nil {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// roundTrip carries out one exchange on pc. On success the response body
+// owns pc and cancel; on failure pc is closed and cancel left to the
+// caller.
+func (c *Client) roundTrip(ctx context.Context, cancel context.CancelFunc, pc *conn, req *request.Request, target *url.URL, jar *Jar) (*response.Response, error) {
+	stop := context.AfterFunc(ctx, func() { pc.Conn.Close() })
+	fail := func(err error) (*response.Response, error) {
+		stop()
+		c.closeConn(pc)
+		return nil, err
+	}
+
+	pc.mark = pc.nread
+	h := c.header(req, target, jar)
+	if _, err := pc.Write(serialize(req.RequestLine.Method, target, h, req.Body)); err != nil {
+		return fail(err)
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		pc.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+	res, body, err := readResponse(pc.br, req.RequestLine.Method)
+	if err != nil {
+		return fail(err)
+	}
+	pc.SetReadDeadline(time.Time{})
+	closing := h.HasToken("Connection", "close")
+
+	var once sync.Once
+	release := func(reuse bool) {
+		once.Do(func() {
+			// stop fails once the context has closed the connection
+			if stop() && reuse && !closing && body.keepAlive() {
+				c.putIdle(pc)
+			} else {
+				c.closeConn(pc)
+			}
+		})
+	}
+
+	if res.StatusCode == response.StatusSwitchingProtocols {
+		res.Body = &switchedBody{Reader: body.switched(), conn: pc, release: release, cancel: cancel}
+		return res, nil
+	}
+	res.Body = &bodyReader{r: body, ctx: ctx, release: release, cancel: cancel, empty: res.ContentLength == 0}
+	return res, nil
+}
+
+// redirect returns the request that follows res, or nil when res is not a
+// redirect to follow. hops counts the redirects followed so far.
+func (c *Client) redirect(req *request.Request, res *response.Response, hops int) (*request.Request, error) {
+	switch res.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+	location, ok := res.Headers.Get("Location")
+	if !ok || c.MaxRedirects < 0 {
+		return nil, nil
+	}
+	max := c.MaxRedirects
+	if max == 0 {
+		max = DefaultMaxRedirects
+	}
+	if hops >= max {
+		return nil, fmt.Errorf("%w: stopped after %d", ErrorTooManyRedirects, max)
+	}
+
+	from, err := parseURL(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	to, err := from.Parse(location)
+	if err != nil || (to.Scheme != "http" && to.Scheme != "https") || to.Host == "" {
+		return nil, fmt.Errorf("%w: redirect to %q", ErrorUnsupportedURL, location)
+	}
+	to.Fragment, to.RawFragment = "", ""
+
+	method, body := req.RequestLine.Method, req.Body
+	h := req.Headers.Clone()
+	status := res.StatusCode
+	if status == response.StatusSeeOther && method != "HEAD" ||
+		(status == response.StatusMovedPermanently || status == response.StatusFound) && method == "POST" {
+		method, body = "GET", nil
+		for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding"} {
+			h.Delete(name)
+		}
+	}
+	h.Replace("Host", to.Host)
+	if !strings.EqualFold(from.Host, to.Host) {
+		h.Delete("Authorization")
+		h.Delete("Cookie")
+	}
+
+	next := request.NewRequest()
+	next.RequestLine = request.RequestLine{Method: method, RequestTarget: to.String(), HttpVersion: "1.1"}
+	next.Headers = h
+	if body != nil {
+		next.Body = body
+	}
+	return next.WithContext(req.Context()), nil
+}
+
+// storeCookies hands the cookies res sets to jar
+func storeCookies(jar *Jar, target *url.URL, res *response.Response) {
+	cookies := []*cookie.Cookie{}
+	for _, folded := range res.Headers.Values("Set-Cookie") {
+		for _, line := range cookie.SplitSetCookie(folded) {
+			if ck, err := cookie.ParseSetCookie(line); err == nil {
+				cookies = append(cookies, ck)
+			}
+		}
+	}
+	if len(cookies) > 0 {
+		jar.setCookies(target, cookies, true)
+	}
+}
+
+// Idempotent reports whether sending a request with method twice has the
+// same effect as sending it once (RFC 9110 section 9.2.2)
+func Idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (c *Client) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	dial := c.Dial
+	if dial == nil {
+		timeout := c.DialTimeout
+		if timeout == 0 {
+			timeout = DefaultDialTimeout
+		}
+		d := &net.Dialer{Timeout: timeout}
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, "tcp", HostPort(target))
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = target.Hostname()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// HostPort returns the address to dial for u, filling in the scheme's
+// default port
+func HostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// header returns the headers req goes out with. Host is filled in when
+// missing, the body always goes out with a Content-Length and cookies from
+// jar are added. With keep-alives disabled the request asks the server to
+// close the connection.
+func (c *Client) header(req *request.Request, target *url.URL, jar *Jar) *headers.Headers {
+	h := req.Headers.Clone()
+	if _, ok := h.Get("Host"); !ok {
+		h.Replace("Host", target.Host)
+	}
+	h.Delete("Transfer-Encoding")
+	switch method := req.RequestLine.Method; {
+	case len(req.Body) > 0:
+		h.Replace("Content-Length", strconv.Itoa(len(req.Body)))
+	case method == "POST" || method == "PUT" || method == "PATCH":
+		h.Replace("Content-Length", "0")
+	default:
+		h.Delete("Content-Length")
+	}
+	if c.DisableKeepAlives {
+		h.Replace("Connection", "close")
+	}
+	if jar != nil {
+		if cookies := jar.header(target); cookies != "" {
+			if prior, ok := h.Get("Cookie"); ok {
+				cookies = prior + "; " + cookies
+			}
+			h.Replace("Cookie", cookies)
+		}
+	}
+	return h
+}
+
+// serialize writes a request in origin form
+func serialize(method string, target *url.URL, h *headers.Headers, body []byte) []byte {
+	b := fmt.Appendf(nil, "%s %s HTTP/1.1\r\n", method, target.RequestURI())
+	h.ForEach(func(key, value string) {
+		b = fmt.Appendf(b, "%s: %s\r\n", key, value)
+	})
+	b = append(b, "\r\n"...)
+	return append(b, body...)
+}
+
+// contextError prefers the reason the context ended over the error it
+// caused, which is usually a read on a closed connection
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// bodyReader streams a response body. Reading it to the end returns the
+// connection to the pool; an error or an early Close discards it.
+type bodyReader struct {
+	r       io.Reader
+	ctx     context.Context
+	release func(reuse bool)
+	// cancel ends the exchange once the body is done with
+	cancel context.CancelFunc
+	// empty is set when the response has no body, so closing it unread
+	// still leaves the connection reusable
+	empty bool
+	err   error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err != nil {
+		if err != io.EOF {
+			err = contextError(b.ctx, err)
+		}
+		b.err = err
+		b.done(err == io.EOF)
+	}
+	return n, err
+}
+
+func (b *bodyReader) Close() error {
+	if b.err == nil {
+		b.err = ErrorBodyClosed
+		b.done(b.empty)
+	}
+	return nil
+}
+
+func (b *bodyReader) done(reuse bool) {
+	b.release(reuse)
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// switchedBody is the body of a 101 response: the connection itself,
+// now speaking whatever protocol the server switched to
+type switchedBody struct {
+	io.Reader
+	conn    net.Conn
+	release func(reuse bool)
+	cancel  context.CancelFunc
+}
+
+func (s *switchedBody) Write(p []byte) (int, error) {
+	return s.conn.Write(p)
+}
+
+func (s *switchedBody) Close() error {
+	s.release(false)
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves handler with this project's server
+func startServer(t *testing.T, handler server.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: handler}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + l.Addr().String()
+}
+
+// startRaw answers every connection with reply once the request head has
+// been read, then closes it
+func startRaw(t *testing.T, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte(reply))
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func readAll(t *testing.T, res *response.Response) string {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestGet(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		body := []byte("hello " + req.Path())
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("X-Custom", "yes")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	})
+
+	res, err := Get(context.Background(), base+"/coffee?roast=dark")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusCode)
+	assert.Equal(t, "OK", res.Reason)
+	assert.Equal(t, int64(13), res.ContentLength)
+	custom, _ := res.Headers.Get("X-Custom")
+	assert.Equal(t, "yes", custom)
+	assert.Equal(t, "hello /coffee", readAll(t, res))
+}
+
+func TestPostBody(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(req.Body)))
+		w.WriteBody(req.Body)
+	})
+
+	req, err := NewRequest(context.Background(), "POST", base+"/echo", []byte(`{"flavor":"dark mode"}`))
+	require.NoError(t, err)
+	res, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `{"flavor":"dark mode"}`, readAll(t, res))
+}
+
+func TestChunkedWithTrailers(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		for _, part := range []string{"first ", "second ", "third"} {
+			w.WriteChunkedBody([]byte(part))
+		}
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc123")
+		w.WriteHeaders(*trailers)
+	})
+
+	res, err := Get(context.Background(), base+"/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), res.ContentLength)
+	assert.Equal(t, "first second third", readAll(t, res))
+	checksum, _ := res.Trailers.Get("X-Checksum")
+	assert.Equal(t, "abc123", checksum)
+}
+
+func TestResponseFraming(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		reply  string
+		status response.StatusCode
+		body   string
+		err    error
+	}{
+		{
+			name:   "Close Delimited",
+			reply:  "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end",
+			status: 200,
+			body:   "until the end",
+		},
+		{
+			name:   "Interim Responses Are Skipped",
+			reply:  "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone",
+			status: 200,
+			body:   "done",
+		},
+		{
+			name:   "HEAD Has No Body",
+			method: "HEAD",
+			reply:  "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n",
+			status: 200,
+		},
+		{
+			name:   "No Content",
+			reply:  "HTTP/1.1 204 No Content\r\n\r\n",
+			status: 204,
+		},
+		{
+			name:   "Bare LF Line Endings",
+			reply:  "HTTP/1.1 201 Created\nContent-Length: 2\n\nok",
+			status: 201,
+			body:   "ok",
+		},
+		{
+			name:   "Truncated Body",
+			reply:  "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort",
+			status: 200,
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "Truncated Chunk",
+			reply:  "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nabc",
+			status: 200,
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+			req, err := NewRequest(context.Background(), method, startRaw(t, tc.reply)+"/", nil)
+			require.NoError(t, err)
+			res, err := DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			assert.Equal(t, tc.status, res.StatusCode)
+
+			body, err := io.ReadAll(res.Body)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, string(body))
+		})
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	for _, reply := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 2000 OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nbad header\r\n\r\n",
+	} {
+		_, err := Get(context.Background(), startRaw(t, reply)+"/")
+		assert.ErrorIs(t, err, ErrorMalformedResponse, reply)
+	}
+}
+
+func TestStreamingBody(t *testing.T) {
+	release := make(chan struct{})
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("first\n"))
+		<-release
+		w.WriteChunkedBody([]byte("second\n"))
+		w.WriteChunkedBodyDone()
+	})
+
+	res, err := Get(context.Background(), base+"/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	br := bufio.NewReader(res.Body)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+	close(release)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+}
+
+func TestTimeouts(t *testing.T) {
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/body" {
+			h := response.GetDefaultHeaders(100)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(*h)
+			w.WriteBody([]byte("partial"))
+		}
+		<-stall
+	})
+
+	t.Run("Client Timeout", func(t *testing.T) {
+		c := &Client{Timeout: 50 * time.Millisecond}
+		_, err := c.Get(context.Background(), base+"/")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Response Header Timeout", func(t *testing.T) {
+		c := &Client{ResponseHeaderTimeout: 50 * time.Millisecond}
+		_, err := c.Get(context.Background(), base+"/")
+		var ne net.Error
+		require.ErrorAs(t, err, &ne)
+		assert.True(t, ne.Timeout())
+	})
+
+	t.Run("Cancel While Reading Body", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		res, err := Get(ctx, base+"/body")
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		buf := make([]byte, 7)
+		_, err = io.ReadFull(res.Body, buf)
+		require.NoError(t, err)
+		giveUp := errors.New("gave up")
+		cancel(giveUp)
+		_, err = io.ReadAll(res.Body)
+		assert.ErrorIs(t, err, giveUp)
+	})
+}
+
+func TestSwitchingProtocols(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		io.Copy(conn, br)
+	}()
+
+	req, err := NewRequest(context.Background(), "GET", "http://"+l.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Connection", "Upgrade")
+	req.Headers.Set("Upgrade", "echo")
+	res, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, response.StatusSwitchingProtocols, res.StatusCode)
+
+	rw, ok := res.Body.(io.ReadWriter)
+	require.True(t, ok)
+	_, err = rw.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(rw, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestHTTPS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.Host)))
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+
+	c := &Client{TLSConfig: upstream.Client().Transport.(*http.Transport).TLSClientConfig}
+	res, err := c.Get(context.Background(), upstream.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "https://"), readAll(t, res))
+}
+
+func TestRejectsUnsupportedURLs(t *testing.T) {
+	for _, url := range []string{"ftp://example.com/", "/relative", "http://"} {
+		_, err := NewRequest(context.Background(), "GET", url, nil)
+		assert.ErrorIs(t, err, ErrorUnsupportedURL, url)
+	}
+}
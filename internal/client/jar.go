@@ -0,0 +1,225 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
+)
+
+// Jar keeps the cookies servers set and hands them back on later requests,
+// following the storage model of RFC 6265 section 5.3. It has no public
+// suffix list: a Domain attribute without a dot, such as "com", is only
+// accepted when it names the request host itself. A Jar is safe for
+// concurrent use.
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	// stored counts the cookies ever stored, to order them by creation
+	stored uint64
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// entry is a stored cookie
+type entry struct {
+	name     string
+	value    string
+	domain   string
+	path     string
+	hostOnly bool
+	secure   bool
+	httpOnly bool
+	// expires is the zero time for session cookies
+	expires time.Time
+	// creation orders entries by when they were first stored
+	creation uint64
+}
+
+func (e *entry) id() string {
+	return e.name + ";" + e.domain + ";" + e.path
+}
+
+func NewJar() *Jar {
+	return &Jar{entries: map[string]*entry{}, now: time.Now}
+}
+
+// SetCookies stores cookies as if u had set them. Like a script in a
+// browser, it cannot set or overwrite HttpOnly cookies; those only come
+// from responses.
+func (j *Jar) SetCookies(u *url.URL, cookies []*cookie.Cookie) {
+	j.setCookies(u, cookies, false)
+}
+
+// Cookies returns the cookies a request to u would carry, leaving out
+// HttpOnly ones
+func (j *Jar) Cookies(u *url.URL) []*cookie.Cookie {
+	return j.cookies(u, false)
+}
+
+// setCookies stores cookies received from u. fromHTTP is set for cookies
+// that came in a Set-Cookie header.
+func (j *Jar) setCookies(u *url.URL, cookies []*cookie.Cookie, fromHTTP bool) {
+	host := canonicalHost(u)
+	if host == "" {
+		return
+	}
+	secure := u.Scheme == "https"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	for _, c := range cookies {
+		e, ok := newEntry(c, host, u.Path, now)
+		if !ok || (e.httpOnly && !fromHTTP) || (e.secure && !secure) {
+			continue
+		}
+		old, exists := j.entries[e.id()]
+		if exists {
+			if old.httpOnly && !fromHTTP {
+				continue
+			}
+			e.creation = old.creation
+		} else {
+			j.stored++
+			e.creation = j.stored
+		}
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, e.id())
+			continue
+		}
+		j.entries[e.id()] = e
+	}
+}
+
+// newEntry applies the domain, path and expiry rules to a cookie from host
+func newEntry(c *cookie.Cookie, host, requestPath string, now time.Time) (*entry, bool) {
+	e := &entry{
+		name:     c.Name,
+		value:    c.Value,
+		domain:   host,
+		hostOnly: true,
+		path:     c.Path,
+		secure:   c.Secure,
+		httpOnly: c.HttpOnly,
+	}
+
+	if domain := strings.TrimSuffix(c.Domain, "."); domain != "" {
+		if !domainMatch(host, domain) {
+			return nil, false
+		}
+		// a single label stands in for a public suffix, which may only
+		// set host-only cookies
+		if !strings.Contains(domain, ".") {
+			if domain != host {
+				return nil, false
+			}
+		} else {
+			e.domain = domain
+			e.hostOnly = false
+		}
+	}
+	if !strings.HasPrefix(e.path, "/") {
+		e.path = defaultPath(requestPath)
+	}
+
+	switch {
+	case c.MaxAge > 0:
+		e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	case c.MaxAge < 0:
+		e.expires = time.Unix(0, 0)
+	case !c.Expires.IsZero():
+		e.expires = c.Expires
+	}
+	return e, true
+}
+
+// cookies returns the cookies to send to u, longest path first and then
+// oldest first, as section 5.4 recommends. Expired cookies are dropped on
+// the way.
+func (j *Jar) cookies(u *url.URL, forHTTP bool) []*cookie.Cookie {
+	host := canonicalHost(u)
+	if host == "" {
+		return nil
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	j.mu.Lock()
+	now := j.now()
+	matched := []*entry{}
+	for id, e := range j.entries {
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, id)
+			continue
+		}
+		if e.hostOnly && host != e.domain || !e.hostOnly && !domainMatch(host, e.domain) {
+			continue
+		}
+		if !pathMatch(path, e.path) || (e.secure && u.Scheme != "https") || (e.httpOnly && !forHTTP) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	j.mu.Unlock()
+
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].path) != len(matched[b].path) {
+			return len(matched[a].path) > len(matched[b].path)
+		}
+		return matched[a].creation < matched[b].creation
+	})
+	cookies := make([]*cookie.Cookie, 0, len(matched))
+	for _, e := range matched {
+		cookies = append(cookies, &cookie.Cookie{Name: e.name, Value: e.value})
+	}
+	return cookies
+}
+
+// header returns the Cookie header for a request to u, empty when no
+// cookie applies
+func (j *Jar) header(u *url.URL) string {
+	pairs := []string{}
+	for _, c := range j.cookies(u, true) {
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func canonicalHost(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// domainMatch reports whether host is domain or a subdomain of it. IP
+// addresses only match themselves.
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return net.ParseIP(host) == nil && strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatch implements section 5.1.4
+func pathMatch(requestPath, cookiePath string) bool {
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return len(requestPath) == len(cookiePath) ||
+		strings.HasSuffix(cookiePath, "/") ||
+		requestPath[len(cookiePath)] == '/'
+}
+
+// defaultPath is the directory of the request path (section 5.1.4)
+func defaultPath(requestPath string) string {
+	i := strings.LastIndex(requestPath, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return requestPath[:i]
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+// store sets cookies on j as if the response to from carried lines
+func store(t *testing.T, j *Jar, from string, lines ...string) {
+	cookies := []*cookie.Cookie{}
+	for _, line := range lines {
+		c, err := cookie.ParseSetCookie(line)
+		require.NoError(t, err)
+		cookies = append(cookies, c)
+	}
+	j.setCookies(mustURL(t, from), cookies, true)
+}
+
+func TestJarMatching(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  string
+		lines []string
+		to    string
+		want  string
+	}{
+		{
+			name:  "Host Only",
+			from:  "http://example.com/",
+			lines: []string{"a=1"},
+			to:    "http://www.example.com/",
+			want:  "",
+		},
+		{
+			name:  "Domain Covers Subdomains",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Domain=example.com"},
+			to:    "http://api.EXAMPLE.com/",
+			want:  "a=1",
+		},
+		{
+			name:  "Domain Must Cover The Host",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Domain=other.com"},
+			to:    "http://other.com/",
+			want:  "",
+		},
+		{
+			name:  "Top Level Domain Refused",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Domain=com"},
+			to:    "http://example.com/",
+			want:  "",
+		},
+		{
+			name:  "IP Addresses Match Only Themselves",
+			from:  "http://127.0.0.1:8080/",
+			lines: []string{"a=1; Domain=0.0.1"},
+			to:    "http://127.0.0.1:9090/",
+			want:  "",
+		},
+		{
+			name:  "Ports Do Not Matter",
+			from:  "http://127.0.0.1:8080/",
+			lines: []string{"a=1"},
+			to:    "http://127.0.0.1:9090/",
+			want:  "a=1",
+		},
+		{
+			name:  "Path Prefix",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Path=/docs"},
+			to:    "http://example.com/docs/web",
+			want:  "a=1",
+		},
+		{
+			name:  "Path Prefix Stops At A Slash",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Path=/docs"},
+			to:    "http://example.com/docsets",
+			want:  "",
+		},
+		{
+			name:  "Default Path Is The Directory",
+			from:  "http://example.com/account/login",
+			lines: []string{"a=1"},
+			to:    "http://example.com/",
+			want:  "",
+		},
+		{
+			name:  "Longest Path First",
+			from:  "http://example.com/",
+			lines: []string{"outer=1; Path=/", "inner=2; Path=/app"},
+			to:    "http://example.com/app/page",
+			want:  "inner=2; outer=1",
+		},
+		{
+			name:  "Secure Only Over HTTPS",
+			from:  "https://example.com/",
+			lines: []string{"a=1; Secure", "b=2"},
+			to:    "http://example.com/",
+			want:  "b=2",
+		},
+		{
+			name:  "Secure Needs A Secure Origin",
+			from:  "http://example.com/",
+			lines: []string{"a=1; Secure"},
+			to:    "https://example.com/",
+			want:  "",
+		},
+		{
+			name:  "Replaced By Name Domain And Path",
+			from:  "http://example.com/",
+			lines: []string{"a=1", "a=2", "a=3; Path=/x"},
+			to:    "http://example.com/x",
+			want:  "a=3; a=2",
+		},
+		{
+			name:  "Max-Age Zero Deletes",
+			from:  "http://example.com/",
+			lines: []string{"a=1", "a=; Max-Age=0"},
+			to:    "http://example.com/",
+			want:  "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			j := NewJar()
+			store(t, j, tc.from, tc.lines...)
+			assert.Equal(t, tc.want, j.header(mustURL(t, tc.to)))
+		})
+	}
+}
+
+func TestJarExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	j := NewJar()
+	j.now = func() time.Time { return now }
+
+	store(t, j, "http://example.com/",
+		"short=1; Max-Age=60",
+		"dated=2; Expires=Thu, 01 Jan 2026 01:00:00 GMT",
+		// Max-Age wins over Expires
+		"both=3; Max-Age=7200; Expires=Thu, 01 Jan 2026 00:00:01 GMT",
+		"session=4",
+		"stale=5; Expires=Wed, 31 Dec 2025 00:00:00 GMT",
+	)
+	u := mustURL(t, "http://example.com/")
+	assert.Equal(t, "short=1; dated=2; both=3; session=4", j.header(u))
+
+	now = now.Add(30 * time.Minute)
+	assert.Equal(t, "dated=2; both=3; session=4", j.header(u))
+	now = now.Add(time.Hour)
+	assert.Equal(t, "both=3; session=4", j.header(u))
+	now = now.Add(time.Hour)
+	assert.Equal(t, "session=4", j.header(u))
+}
+
+func TestJarHttpOnly(t *testing.T) {
+	j := NewJar()
+	u := mustURL(t, "http://example.com/")
+	store(t, j, "http://example.com/", "session=server; HttpOnly")
+
+	// code cannot read or overwrite an HttpOnly cookie
+	assert.Empty(t, j.Cookies(u))
+	j.SetCookies(u, []*cookie.Cookie{{Name: "session", Value: "forged"}, {Name: "theme", Value: "dark"}})
+	j.SetCookies(u, []*cookie.Cookie{{Name: "sneaky", Value: "1", HttpOnly: true}})
+	assert.Equal(t, []*cookie.Cookie{{Name: "theme", Value: "dark"}}, j.Cookies(u))
+
+	// requests carry it
+	assert.Equal(t, "session=server; theme=dark", j.header(u))
+}
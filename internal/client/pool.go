@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline that has always passed, used to wake a
+// blocked read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// conn is a connection managed by a Client's pool
+type conn struct {
+	net.Conn
+	br  *bufio.Reader
+	key string
+	// reused is set when the connection came out of the idle pool
+	reused bool
+	// nread counts the bytes read so far and mark its value when the
+	// current request went out, telling whether any response arrived
+	nread, mark int64
+
+	// the fields below are guarded by the pool's mutex
+	idle   bool
+	closed bool
+	timer  *time.Timer
+	// peeked receives the result of the watch on an idle connection
+	peeked chan error
+}
+
+func (pc *conn) Read(p []byte) (int, error) {
+	n, err := pc.Conn.Read(p)
+	pc.nread += int64(n)
+	return n, err
+}
+
+// alive ends the watch on a connection just taken from the pool and
+// reports whether the server has neither closed it nor sent anything
+func (pc *conn) alive() bool {
+	pc.SetReadDeadline(aLongTimeAgo)
+	err := <-pc.peeked
+	pc.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// pool holds a Client's idle connections by scheme and address, along with
+// the number of open connections and the requests waiting for one
+type pool struct {
+	mu      sync.Mutex
+	idle    map[string][]*conn
+	nidle   int
+	open    map[string]int
+	waiting map[string][]chan struct{}
+}
+
+func (p *pool) init() {
+	if p.idle == nil {
+		p.idle = map[string][]*conn{}
+		p.open = map[string]int{}
+		p.waiting = map[string][]chan struct{}{}
+	}
+}
+
+// getConn returns an idle connection to target that is still usable, or
+// dials a new one. Unless fresh is set, idle connections are tried first,
+// most recently used first. Past MaxConnsPerHost it waits for a
+// connection to be returned or closed.
+func (c *Client) getConn(ctx context.Context, target *url.URL, fresh bool) (*conn, error) {
+	p := &c.pool
+	key := target.Scheme + "://" + HostPort(target)
+	for {
+		p.mu.Lock()
+		p.init()
+		if list := p.idle[key]; !fresh && len(list) > 0 {
+			pc := list[len(list)-1]
+			p.remove(pc)
+			p.mu.Unlock()
+			if pc.alive() {
+				pc.reused = true
+				return pc, nil
+			}
+			c.closeConn(pc)
+			continue
+		}
+
+		if c.MaxConnsPerHost <= 0 || p.open[key] < c.MaxConnsPerHost {
+			p.open[key]++
+			p.mu.Unlock()
+			nc, err := c.dial(ctx, target)
+			if err != nil {
+				p.mu.Lock()
+				p.forget(key)
+				p.mu.Unlock()
+				return nil, err
+			}
+			pc := &conn{Conn: nc, key: key}
+			pc.br = bufio.NewReader(pc)
+			return pc, nil
+		}
+
+		wait := make(chan struct{})
+		p.waiting[key] = append(p.waiting[key], wait)
+		p.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.mu.Lock()
+			if !p.unwait(key, wait) {
+				// woken as the context ended: pass the turn on
+				p.wake(key)
+			}
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// putIdle returns pc to the pool, or closes it when the pool is full
+func (c *Client) putIdle(pc *conn) {
+	maxIdle := c.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+	perHost := c.MaxIdleConnsPerHost
+	if perHost == 0 {
+		perHost = DefaultMaxIdleConnsPerHost
+	}
+	timeout := c.IdleConnTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleConnTimeout
+	}
+
+	p := &c.pool
+	p.mu.Lock()
+	if p.nidle >= maxIdle || len(p.idle[pc.key]) >= perHost {
+		p.mu.Unlock()
+		c.closeConn(pc)
+		return
+	}
+	pc.idle = true
+	pc.peeked = make(chan error, 1)
+	pc.timer = time.AfterFunc(timeout, func() { c.evict(pc) })
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+	p.nidle++
+	p.wake(pc.key)
+	p.mu.Unlock()
+
+	go c.watch(pc)
+}
+
+// watch blocks on an idle connection until the server closes it or a
+// request takes it. A server that closes the connection, or sends
+// anything while no request is outstanding, takes it out of the pool.
+func (c *Client) watch(pc *conn) {
+	_, err := pc.br.Peek(1)
+	pc.peeked <- err
+	c.evict(pc)
+}
+
+// evict closes pc if it is still idle
+func (c *Client) evict(pc *conn) {
+	c.pool.mu.Lock()
+	idle := pc.idle
+	if idle {
+		c.pool.remove(pc)
+	}
+	c.pool.mu.Unlock()
+	if idle {
+		c.closeConn(pc)
+	}
+}
+
+// closeConn closes pc and frees its slot for waiting requests
+func (c *Client) closeConn(pc *conn) {
+	pc.Conn.Close()
+	c.pool.mu.Lock()
+	if !pc.closed {
+		pc.closed = true
+		c.pool.forget(pc.key)
+	}
+	c.pool.mu.Unlock()
+}
+
+// CloseIdleConnections closes every connection sitting idle in the pool.
+// Connections in use are left alone.
+func (c *Client) CloseIdleConnections() {
+	p := &c.pool
+	p.mu.Lock()
+	conns := []*conn{}
+	for _, list := range p.idle {
+		conns = append(conns, list...)
+	}
+	for _, pc := range conns {
+		p.remove(pc)
+	}
+	p.mu.Unlock()
+
+	for _, pc := range conns {
+		c.closeConn(pc)
+	}
+}
+
+// remove takes an idle connection out of the pool
+func (p *pool) remove(pc *conn) {
+	list := p.idle[pc.key]
+	for i, other := range list {
+		if other == pc {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(p.idle, pc.key)
+	} else {
+		p.idle[pc.key] = list
+	}
+	p.nidle--
+	pc.idle = false
+	pc.timer.Stop()
+}
+
+// forget drops a closed connection from the count for key
+func (p *pool) forget(key string) {
+	p.open[key]--
+	if p.open[key] <= 0 {
+		delete(p.open, key)
+	}
+	p.wake(key)
+}
+
+// wake lets the longest waiting request for key try again
+func (p *pool) wake(key string) {
+	list := p.waiting[key]
+	if len(list) == 0 {
+		return
+	}
+	close(list[0])
+	if len(list) == 1 {
+		delete(p.waiting, key)
+	} else {
+		p.waiting[key] = list[1:]
+	}
+}
+
+// unwait removes a waiter that gave up and reports whether it was still
+// waiting
+func (p *pool) unwait(key string, wait chan struct{}) bool {
+	list := p.waiting[key]
+	for i, other := range list {
+		if other == wait {
+			list = append(list[:i], list[i+1:]...)
+			if len(list) == 0 {
+				delete(p.waiting, key)
+			} else {
+				p.waiting[key] = list
+			}
+			return true
+		}
+	}
+	return false
+}
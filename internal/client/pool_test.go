@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startKeepAlive serves the client's address as the body of every
+// response, on connections that stay open
+func startKeepAlive(t *testing.T) string {
+	return startServer(t, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RemoteAddr)
+		h := response.GetDefaultHeaders(len(body))
+		h.Delete("Connection")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	})
+}
+
+func idleConns(c *Client) int {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+	return c.pool.nidle
+}
+
+func TestReusesConnections(t *testing.T) {
+	base := startKeepAlive(t)
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	res, err := c.Get(context.Background(), base+"/")
+	require.NoError(t, err)
+	first := readAll(t, res)
+	assert.Equal(t, 1, idleConns(c))
+
+	for range 3 {
+		res, err := c.Get(context.Background(), base+"/")
+		require.NoError(t, err)
+		assert.Equal(t, first, readAll(t, res))
+	}
+}
+
+func TestConnectionsNotReused(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *Client
+		// use reads and closes the response
+		use func(t *testing.T, res *response.Response)
+	}{
+		{
+			name:   "Body Closed Unread",
+			client: &Client{},
+			use: func(t *testing.T, res *response.Response) {
+				res.Body.Close()
+			},
+		},
+		{
+			name:   "Keep Alives Disabled",
+			client: &Client{DisableKeepAlives: true},
+			use: func(t *testing.T, res *response.Response) {
+				readAll(t, res)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base := startKeepAlive(t)
+			for range 2 {
+				res, err := tc.client.Get(context.Background(), base+"/")
+				require.NoError(t, err)
+				tc.use(t, res)
+				assert.Equal(t, 0, idleConns(tc.client))
+			}
+		})
+	}
+}
+
+func TestServerAsksToClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{name: "Connection Close", reply: "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok"},
+		{name: "HTTP/1.0", reply: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok"},
+		{name: "Close Delimited", reply: "HTTP/1.1 200 OK\r\n\r\nok"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Client{}
+			res, err := c.Get(context.Background(), startRaw(t, tc.reply)+"/")
+			require.NoError(t, err)
+			assert.Equal(t, "ok", readAll(t, res))
+			assert.Equal(t, 0, idleConns(c))
+		})
+	}
+}
+
+func TestIdleLimits(t *testing.T) {
+	release := make(chan struct{})
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		<-release
+		h := response.GetDefaultHeaders(2)
+		h.Delete("Connection")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte("ok"))
+	})
+
+	c := &Client{MaxIdleConnsPerHost: 2}
+	defer c.CloseIdleConnections()
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Get(context.Background(), base+"/")
+			if assert.NoError(t, err) {
+				io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 2, idleConns(c))
+
+	c.CloseIdleConnections()
+	assert.Equal(t, 0, idleConns(c))
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	base := startKeepAlive(t)
+	c := &Client{MaxConnsPerHost: 1}
+	defer c.CloseIdleConnections()
+
+	held, err := c.Get(context.Background(), base+"/")
+	require.NoError(t, err)
+
+	// a second request waits for the only connection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Get(ctx, base+"/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	got := make(chan string, 1)
+	go func() {
+		res, err := c.Get(context.Background(), base+"/")
+		if assert.NoError(t, err) {
+			got <- readAll(t, res)
+		}
+	}()
+	select {
+	case <-got:
+		t.Fatal("request went out over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	addr := readAll(t, held)
+	select {
+	case reused := <-got:
+		assert.Equal(t, addr, reused)
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting request never got the connection")
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	base := startKeepAlive(t)
+	c := &Client{IdleConnTimeout: 50 * time.Millisecond}
+
+	res, err := c.Get(context.Background(), base+"/")
+	require.NoError(t, err)
+	first := readAll(t, res)
+	assert.Equal(t, 1, idleConns(c))
+
+	require.Eventually(t, func() bool { return idleConns(c) == 0 }, time.Second, 10*time.Millisecond)
+	res, err = c.Get(context.Background(), base+"/")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, readAll(t, res))
+}
+
+// startFlaky answers the first request on every connection and then hangs
+// up on the second without a word. With closeIdle set it hangs up as soon
+// as the first response is out instead.
+func startFlaky(t *testing.T, closeIdle bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				readHead := func() bool {
+					for {
+						line, err := br.ReadString('\n')
+						if err != nil {
+							return false
+						}
+						if line == "\r\n" {
+							return true
+						}
+					}
+				}
+				if !readHead() {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				if !closeIdle {
+					readHead()
+				}
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestStaleConnections(t *testing.T) {
+	t.Run("Closed While Idle", func(t *testing.T) {
+		base := startFlaky(t, true)
+		c := &Client{}
+		for range 3 {
+			res, err := c.Get(context.Background(), base+"/")
+			require.NoError(t, err)
+			assert.Equal(t, "ok", readAll(t, res))
+			// the pool notices the close on its own
+			require.Eventually(t, func() bool { return idleConns(c) == 0 }, time.Second, 10*time.Millisecond)
+		}
+	})
+
+	t.Run("Closed As The Request Went Out", func(t *testing.T) {
+		base := startFlaky(t, false)
+		c := &Client{}
+		defer c.CloseIdleConnections()
+
+		res, err := c.Get(context.Background(), base+"/")
+		require.NoError(t, err)
+		readAll(t, res)
+
+		// an idempotent request is retried on a new connection
+		res, err = c.Get(context.Background(), base+"/")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", readAll(t, res))
+
+		// a POST might have been acted on, so the error is returned
+		req, err := NewRequest(context.Background(), "POST", base+"/", []byte("once"))
+		require.NoError(t, err)
+		_, err = c.Do(req)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
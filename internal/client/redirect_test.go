@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reply writes status with body and extra header pairs
+func reply(w *response.Writer, status response.StatusCode, body string, kv ...string) {
+	h := response.GetDefaultHeaders(len(body))
+	h.Delete("Connection")
+	for i := 0; i+1 < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+// startRedirector redirects /redirect/{status} to the location query
+// parameter, /echo by default, and answers /echo with what arrived
+func startRedirector(t *testing.T) string {
+	return startServer(t, func(w *response.Writer, req *request.Request) {
+		u, _ := url.Parse(req.RequestLine.RequestTarget)
+		switch {
+		case u.Path == "/echo":
+			auth, _ := req.Headers.Get("Authorization")
+			_, sized := req.Headers.Get("Content-Type")
+			reply(w, response.StatusOK, fmt.Sprintf("%s %q auth=%q typed=%v", req.RequestLine.Method, req.Body, auth, sized))
+		case u.Path == "/loop":
+			reply(w, response.StatusFound, "", "Location", "/loop")
+		default:
+			status, _ := strconv.Atoi(u.Path[len("/redirect/"):])
+			location := u.Query().Get("location")
+			if location == "" {
+				location = "/echo"
+			}
+			reply(w, response.StatusCode(status), "moved", "Location", location)
+		}
+	})
+}
+
+func TestRedirectMethods(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+		want   string
+	}{
+		{name: "301 GET", method: "GET", status: 301, want: `GET "" auth="secret" typed=false`},
+		{name: "301 POST Becomes GET", method: "POST", status: 301, want: `GET "" auth="secret" typed=false`},
+		{name: "302 POST Becomes GET", method: "POST", status: 302, want: `GET "" auth="secret" typed=false`},
+		{name: "302 PUT Keeps Its Body", method: "PUT", status: 302, want: `PUT "form" auth="secret" typed=true`},
+		{name: "303 PUT Becomes GET", method: "PUT", status: 303, want: `GET "" auth="secret" typed=false`},
+		{name: "303 HEAD Stays HEAD", method: "HEAD", status: 303},
+		{name: "307 POST Replays Body", method: "POST", status: 307, want: `POST "form" auth="secret" typed=true`},
+		{name: "308 PATCH Replays Body", method: "PATCH", status: 308, want: `PATCH "form" auth="secret" typed=true`},
+	}
+
+	base := startRedirector(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var body []byte
+			if tc.method != "GET" && tc.method != "HEAD" {
+				body = []byte("form")
+			}
+			req, err := NewRequest(context.Background(), tc.method, fmt.Sprintf("%s/redirect/%d", base, tc.status), body)
+			require.NoError(t, err)
+			req.Headers.Set("Authorization", "secret")
+			if body != nil {
+				req.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			res, err := DefaultClient.Do(req)
+			require.NoError(t, err)
+			assert.Equal(t, response.StatusOK, res.StatusCode)
+			assert.Equal(t, tc.want, readAll(t, res))
+		})
+	}
+}
+
+func TestRedirectAcrossHosts(t *testing.T) {
+	first := startRedirector(t)
+	second := startRedirector(t)
+
+	req, err := NewRequest(context.Background(), "GET", first+"/redirect/302?location="+url.QueryEscape(second+"/echo"), nil)
+	require.NoError(t, err)
+	req.Headers.Set("Authorization", "secret")
+	res, err := DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, `GET "" auth="" typed=false`, readAll(t, res))
+}
+
+func TestRedirectLimits(t *testing.T) {
+	base := startRedirector(t)
+
+	_, err := (&Client{MaxRedirects: 3}).Get(context.Background(), base+"/loop")
+	assert.ErrorIs(t, err, ErrorTooManyRedirects)
+
+	res, err := (&Client{MaxRedirects: -1}).Get(context.Background(), base+"/redirect/302")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, res.StatusCode)
+	location, _ := res.Headers.Get("Location")
+	assert.Equal(t, "/echo", location)
+	assert.Equal(t, "moved", readAll(t, res))
+
+	_, err = DefaultClient.Get(context.Background(), base+"/redirect/302?location="+url.QueryEscape("ftp://example.com/"))
+	assert.ErrorIs(t, err, ErrorUnsupportedURL)
+
+	// RoundTrip never follows
+	req, err := NewRequest(context.Background(), "GET", base+"/redirect/307", nil)
+	require.NoError(t, err)
+	res, err = DefaultClient.RoundTrip(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, response.StatusTemporaryRedirect, res.StatusCode)
+}
+
+func TestLoginFlow(t *testing.T) {
+	base := startServer(t, func(w *response.Writer, req *request.Request) {
+		cookies, _ := req.Headers.Get("Cookie")
+		switch req.Path() {
+		case "/login":
+			if string(req.Body) != "user=ada&pass=hunter2" {
+				reply(w, response.StatusUnauthorized, "bad credentials")
+				return
+			}
+			reply(w, response.StatusSeeOther, "",
+				"Location", "/account",
+				"Set-Cookie", "session=s3cr3t; Path=/; HttpOnly",
+				"Set-Cookie", "seen=1; Expires=Wed, 21 Oct 2099 07:28:00 GMT; Path=/",
+			)
+		case "/account":
+			if cookies != "session=s3cr3t; seen=1" {
+				reply(w, response.StatusUnauthorized, "who are you? "+cookies)
+				return
+			}
+			reply(w, response.StatusOK, "welcome back")
+		case "/logout":
+			reply(w, response.StatusFound, "", "Location", "/account", "Set-Cookie", "session=; Max-Age=0; Path=/")
+		}
+	})
+
+	c := &Client{Jar: NewJar()}
+	req, err := NewRequest(context.Background(), "POST", base+"/login", []byte("user=ada&pass=hunter2"))
+	require.NoError(t, err)
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusCode)
+	assert.Equal(t, "welcome back", readAll(t, res))
+
+	res, err = c.Get(context.Background(), base+"/logout")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, "who are you? seen=1", readAll(t, res))
+}
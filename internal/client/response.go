@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+)
+
+// readSize is how much is read from the connection at a time
+const readSize = 32 << 10
+
+// responseReader feeds a connection to a response parser. Once the head
+// is parsed it reads as the decoded body.
+type responseReader struct {
+	br *bufio.Reader
+	p  *response.Parser
+	// buf holds bytes read but not yet parsed
+	buf   []byte
+	chunk []byte
+	err   error
+}
+
+// readResponse reads the head of the response to a request sent with
+// method. Interim 1xx responses are skipped, apart from 101 which ends
+// the exchange.
+func readResponse(br *bufio.Reader, method string) (*response.Response, *responseReader, error) {
+	r := &responseReader{br: br, p: response.NewParser(method)}
+	for !r.p.HeadDone() {
+		if err := r.more(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return r.p.Response(), r, nil
+}
+
+// more reads once from the connection and parses what it can
+func (r *responseReader) more() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.chunk == nil {
+		r.chunk = make([]byte, readSize)
+	}
+	n, err := r.br.Read(r.chunk)
+	if n > 0 {
+		r.buf = append(r.buf, r.chunk[:n]...)
+		used, perr := r.p.Parse(r.buf)
+		if perr != nil {
+			r.err = perr
+			return perr
+		}
+		r.buf = append(r.buf[:0], r.buf[used:]...)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+		if len(r.buf) == 0 {
+			err = r.p.EOF()
+		}
+	}
+	r.err = err
+	return err
+}
+
+func (r *responseReader) Read(p []byte) (int, error) {
+	for len(r.p.Body) == 0 {
+		if r.p.Done() {
+			return 0, io.EOF
+		}
+		if err := r.more(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.p.Body)
+	if n == len(r.p.Body) {
+		r.p.Body = r.p.Body[:0]
+	} else {
+		r.p.Body = r.p.Body[n:]
+	}
+	return n, nil
+}
+
+// switched returns what follows a 101 response: the bytes already read
+// and then the rest of the connection
+func (r *responseReader) switched() io.Reader {
+	return io.MultiReader(bytes.NewReader(r.buf), r.br)
+}
+
+// keepAlive reports whether the connection can carry another request
+// once the body has been read. Bytes past the end of the response mean
+// the server is out of step with us.
+func (r *responseReader) keepAlive() bool {
+	return r.p.KeepAlive() && len(r.buf) == 0
+}
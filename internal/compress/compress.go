@@ -0,0 +1,213 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// DefaultMinSize is the smallest Content-Length worth compressing
+const DefaultMinSize = 1024
+
+// DefaultSkipTypes lists content types that are already compressed. An
+// entry ending in "/" matches every subtype.
+var DefaultSkipTypes = []string{
+	"video/",
+	"audio/",
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+}
+
+type Options struct {
+	// MinSize is the smallest Content-Length that gets compressed. Bodies of
+	// unknown length (chunked) are always compressed. Defaults to DefaultMinSize.
+	MinSize int
+	// Level is the compression level, gzip.DefaultCompression when zero
+	Level int
+	// SkipTypes overrides DefaultSkipTypes
+	SkipTypes []string
+}
+
+// Middleware compresses responses with gzip or deflate, whichever the
+// client prefers according to Accept-Encoding.
+func Middleware(opts Options) server.Middleware {
+	if opts.MinSize <= 0 {
+		opts.MinSize = DefaultMinSize
+	}
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+	if opts.SkipTypes == nil {
+		opts.SkipTypes = DefaultSkipTypes
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Method != "HEAD" {
+				accept, _ := req.Headers.Get("Accept-Encoding")
+				encoding := Negotiate(accept)
+				w.SetBodyFilter(func(status response.StatusCode, h *headers.Headers, body io.Writer) io.WriteCloser {
+					return opts.filter(encoding, status, h, body)
+				})
+			}
+
+			next(w, req)
+			w.Finish()
+		}
+	}
+}
+
+func (o Options) filter(encoding string, status response.StatusCode, h *headers.Headers, body io.Writer) io.WriteCloser {
+	if status < 200 || status == 204 || status == 304 {
+		return nil
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return nil
+	}
+	contentType, _ := h.Get("Content-Type")
+	if o.skipType(contentType) {
+		return nil
+	}
+
+	// the body varies with Accept-Encoding even when we end up not compressing it
+	h.Set("Vary", "Accept-Encoding")
+
+	if encoding == "" {
+		return nil
+	}
+	if length, ok := h.Get("Content-Length"); ok {
+		n, err := strconv.Atoi(length)
+		if err == nil && n < o.MinSize {
+			return nil
+		}
+	}
+
+	var enc io.WriteCloser
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		enc, err = gzip.NewWriterLevel(body, o.Level)
+	case EncodingDeflate:
+		enc, err = zlib.NewWriterLevel(body, o.Level)
+	}
+	if err != nil {
+		return nil
+	}
+
+	h.Replace("Content-Encoding", encoding)
+	return enc
+}
+
+func (o Options) skipType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	for _, t := range o.SkipTypes {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate picks the supported encoding with the highest q-value in an
+// Accept-Encoding header, preferring gzip on ties. It returns "" when the
+// body should be sent as is.
+func Negotiate(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+	wildcard := -1.0
+	seen := map[string]bool{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		if coding != EncodingGzip && coding != EncodingDeflate {
+			continue
+		}
+
+		seen[coding] = true
+		if q > bestQ || (q == bestQ && q > 0 && coding == EncodingGzip) {
+			best, bestQ = coding, q
+		}
+	}
+
+	// "*" covers every coding not listed explicitly
+	if wildcard > bestQ {
+		for _, coding := range []string{EncodingGzip, EncodingDeflate} {
+			if !seen[coding] {
+				return coding
+			}
+		}
+	}
+	return best
+}
+
+// DecodeRequest makes request bodies sent with a Content-Encoding reach the
+// handler already decoded. Bodies that decode past maxSize bytes are
+// answered with 413, unknown encodings with 415.
+func DecodeRequest(maxSize int) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			err := req.DecodeBody(maxSize)
+			switch {
+			case err == nil:
+				next(w, req)
+			case errors.Is(err, request.ErrorUnsupportedContentEncoding):
+				w.WriteStatusLine(response.StatusUnsupportedMediaType)
+				h := response.GetDefaultHeaders(len(err.Error()))
+				h.Set("Accept-Encoding", strings.Join(request.SupportedContentEncodings, ", "))
+				w.WriteHeaders(*h)
+				w.WriteBody([]byte(err.Error()))
+			case errors.Is(err, request.ErrorBodyTooLarge):
+				server.HandlerError{StatusCode: response.StatusPayloadTooLarge, Message: err.Error()}.Write(w)
+			default:
+				server.HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()}.Write(w)
+			}
+		}
+	}
+}
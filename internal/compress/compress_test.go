@@ -0,0 +1,242 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+// splitResponse returns the lower-cased header block and the de-chunked body
+func splitResponse(t *testing.T, raw string) (map[string]string, []byte) {
+	head, body, ok := strings.Cut(raw, "\r\n\r\n")
+	require.True(t, ok)
+
+	h := map[string]string{}
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		key, value, _ := strings.Cut(line, ": ")
+		h[strings.ToLower(key)] = value
+	}
+
+	if h["transfer-encoding"] != "chunked" {
+		return h, []byte(body)
+	}
+
+	out := []byte{}
+	r := bufio.NewReader(strings.NewReader(body))
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		out = append(out, chunk[:size]...)
+	}
+	return h, out
+}
+
+func serve(t *testing.T, h func(w *response.Writer, r *request.Request), raw string) (map[string]string, []byte) {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bufferCloser{}
+	w := response.NewWriter(buf)
+	Middleware(Options{MinSize: 16})(h)(w, req)
+
+	return splitResponse(t, buf.String())
+}
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "empty", header: "", expected: ""},
+		{name: "gzip only", header: "gzip", expected: "gzip"},
+		{name: "gzip preferred on tie", header: "deflate, gzip", expected: "gzip"},
+		{name: "q-values", header: "gzip;q=0.5, deflate;q=0.8", expected: "deflate"},
+		{name: "refused", header: "gzip;q=0, deflate;q=0", expected: ""},
+		{name: "unsupported only", header: "br", expected: ""},
+		{name: "wildcard", header: "br, *;q=0.1", expected: "gzip"},
+		{name: "wildcard minus gzip", header: "gzip;q=0, *", expected: "deflate"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Negotiate(tc.header))
+		})
+	}
+}
+
+func TestHandlerCompressesFixedLengthBody(t *testing.T) {
+	body := strings.Repeat("<p>hello</p>", 100)
+	h, out := serve(t, func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		hdrs := response.GetDefaultHeaders(len(body))
+		hdrs.Replace("Content-Type", "text/html")
+		w.WriteHeaders(*hdrs)
+		w.WriteBody([]byte(body))
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+
+	assert.Equal(t, "gzip", h["content-encoding"])
+	assert.Equal(t, "Accept-Encoding", h["vary"])
+	assert.Equal(t, "chunked", h["transfer-encoding"])
+	_, ok := h["content-length"]
+	assert.False(t, ok)
+
+	zr, err := gzip.NewReader(bytes.NewReader(out))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(decoded))
+	assert.Less(t, len(out), len(body))
+}
+
+func TestHandlerCompressesChunkedBodyWithTrailers(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: deflate\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bufferCloser{}
+	w := response.NewWriter(buf)
+	Middleware(Options{})(func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		hdrs := response.GetDefaultHeaders(0)
+		hdrs.Delete("Content-Length")
+		hdrs.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(*hdrs)
+		w.WriteChunkedBody([]byte("first chunk "))
+		w.WriteChunkedBody([]byte("second chunk"))
+		w.WriteChunkedBodyDone()
+		trailers := response.GetDefaultHeaders(0)
+		trailers.Delete("Content-Length")
+		trailers.Delete("Connection")
+		trailers.Delete("Content-Type")
+		trailers.Set("X-Checksum", "abc")
+		w.WriteHeaders(*trailers)
+	})(w, req)
+
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nx-checksum: abc\r\n\r\n"))
+
+	h, out := splitResponse(t, buf.String())
+	assert.Equal(t, "deflate", h["content-encoding"])
+
+	zr, err := zlib.NewReader(bytes.NewReader(out))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "first chunk second chunk", string(decoded))
+}
+
+func TestHandlerLeavesBodyAlone(t *testing.T) {
+	body := strings.Repeat("x", 64)
+	write := func(contentType string, length int) func(w *response.Writer, r *request.Request) {
+		return func(w *response.Writer, r *request.Request) {
+			w.WriteStatusLine(response.StatusOK)
+			hdrs := response.GetDefaultHeaders(length)
+			hdrs.Replace("Content-Type", contentType)
+			w.WriteHeaders(*hdrs)
+			w.WriteBody([]byte(body[:length]))
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		handler    func(w *response.Writer, r *request.Request)
+		request    string
+		expectVary bool
+	}{
+		{
+			name:       "no accept-encoding",
+			handler:    write("text/html", 64),
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			expectVary: true,
+		},
+		{
+			name:       "already compressed type",
+			handler:    write("video/mp4", 64),
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n",
+			expectVary: false,
+		},
+		{
+			name:       "below minimum size",
+			handler:    write("text/html", 8),
+			request:    "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n",
+			expectVary: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, out := serve(t, tc.handler, tc.request)
+			_, ok := h["content-encoding"]
+			assert.False(t, ok)
+			_, ok = h["vary"]
+			assert.Equal(t, tc.expectVary, ok)
+			assert.NotEmpty(t, h["content-length"])
+			assert.Equal(t, h["content-length"], strconv.Itoa(len(out)))
+		})
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte(`{"cpu":0.5}`))
+	zw.Close()
+
+	testCases := []struct {
+		name           string
+		encoding       string
+		maxSize        int
+		expectedStatus string
+		expectedBody   string
+	}{
+		{name: "decoded", encoding: "gzip", maxSize: 1024, expectedStatus: "200", expectedBody: `{"cpu":0.5}`},
+		{name: "too large", encoding: "gzip", maxSize: 4, expectedStatus: "413"},
+		{name: "unsupported", encoding: "br", maxSize: 1024, expectedStatus: "415"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := "POST /ingest HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: " + tc.encoding +
+				"\r\nContent-Length: " + strconv.Itoa(body.Len()) + "\r\n\r\n" + body.String()
+			req, err := request.RequestFromReader(strings.NewReader(raw))
+			require.NoError(t, err)
+
+			buf := &bufferCloser{}
+			DecodeRequest(tc.maxSize)(func(w *response.Writer, r *request.Request) {
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(*response.GetDefaultHeaders(len(r.Body)))
+				w.WriteBody(r.Body)
+			})(response.NewWriter(buf), req)
+
+			assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 "+tc.expectedStatus+" "))
+			if tc.expectedBody != "" {
+				_, out := splitResponse(t, buf.String())
+				assert.Equal(t, tc.expectedBody, string(out))
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package cookie
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+)
+
+var ErrorMalformedCookie = fmt.Errorf("malformed cookie")
+var ErrorInvalidCookie = fmt.Errorf("invalid cookie")
+
+// SameSite is the SameSite attribute of a cookie
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is an HTTP cookie as set by a Set-Cookie header (RFC 6265)
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+	// Expires is the zero time when the attribute is absent
+	Expires time.Time
+	// MaxAge is in seconds. Zero means the attribute is absent and a
+	// negative value stands for "Max-Age=0", which deletes the cookie.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// ParseSetCookie parses the value of a Set-Cookie header following the
+// lenient algorithm of RFC 6265 section 5.2: unknown attributes and
+// attributes with bad values are ignored, only a missing name makes the
+// whole cookie invalid.
+func ParseSetCookie(line string) (*Cookie, error) {
+	parts := strings.Split(line, ";")
+	name, value, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%w: %q", ErrorMalformedCookie, line)
+	}
+	c := &Cookie{Name: name, Value: trimQuotes(strings.TrimSpace(value))}
+
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(attr, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		switch key {
+		case "expires":
+			if t, ok := parseDate(val); ok {
+				c.Expires = t
+			}
+		case "max-age":
+			// a leading "+" is not allowed, unlike for strconv
+			if val == "" || val[0] == '+' {
+				continue
+			}
+			secs, err := strconv.Atoi(val)
+			if err != nil {
+				continue
+			}
+			c.MaxAge = secs
+			if secs <= 0 {
+				c.MaxAge = -1
+			}
+		case "domain":
+			c.Domain = strings.ToLower(strings.TrimPrefix(val, "."))
+		case "path":
+			c.Path = val
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
+
+// ParseCookie parses the value of a Cookie header into its name=value
+// pairs, in order. Pairs without a valid name are skipped.
+func ParseCookie(line string) []*Cookie {
+	cookies := []*Cookie{}
+	for _, pair := range strings.Split(line, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if !isToken(name) {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: trimQuotes(value)})
+	}
+	return cookies
+}
+
+// Valid reports why c cannot be sent in a Set-Cookie header: a name that
+// is not a token, a value or path with characters RFC 6265 section 4.1.1
+// leaves out, a domain that is not a host name or an IP address, or
+// SameSite=None or Partitioned without Secure, which browsers refuse.
+func (c *Cookie) Valid() error {
+	switch {
+	case !isToken(c.Name):
+		return fmt.Errorf("%w: name %q", ErrorInvalidCookie, c.Name)
+	case !validValue(c.Value):
+		return fmt.Errorf("%w: value %q", ErrorInvalidCookie, c.Value)
+	case !validPath(c.Path):
+		return fmt.Errorf("%w: path %q", ErrorInvalidCookie, c.Path)
+	case c.Domain != "" && !validDomain(c.Domain):
+		return fmt.Errorf("%w: domain %q", ErrorInvalidCookie, c.Domain)
+	case c.SameSite == SameSiteNone && !c.Secure:
+		return fmt.Errorf("%w: SameSite=None without Secure", ErrorInvalidCookie)
+	case c.Partitioned && !c.Secure:
+		return fmt.Errorf("%w: Partitioned without Secure", ErrorInvalidCookie)
+	}
+	return nil
+}
+
+// String serializes c as the value of a Set-Cookie header. It does not
+// check c; SetCookie does.
+func (c *Cookie) String() string {
+	b := strings.Builder{}
+	b.WriteString(c.Name + "=" + c.Value)
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(dateLayouts[0]))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// SetCookie adds c to h on a Set-Cookie line of its own, after checking it
+// with Valid
+func SetCookie(h *headers.Headers, c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	h.Add("Set-Cookie", c.String())
+	return nil
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue accepts cookie-octets, optionally wrapped in double quotes
+func validValue(s string) bool {
+	if len(s) > 1 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func validPath(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] >= 0x7f || s[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain accepts IP addresses and host names made of letters, digits
+// and hyphens, with an optional leading dot
+func validDomain(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	s = strings.TrimPrefix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i] | 0x20
+			if !(c >= 'a' && c <= 'z') && !(label[i] >= '0' && label[i] <= '9') && label[i] != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dateLayouts are the date formats seen in Expires attributes: the
+// IMF-fixdate of RFC 9110 first, then the obsolete ones still in the wild
+var dateLayouts = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	"Mon, 02-Jan-2006 15:04:05 GMT",
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func trimQuotes(s string) string {
+	if len(s) > 1 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// SplitSetCookie separates Set-Cookie values that were folded into one
+// comma-separated field. A comma only starts a new cookie when a name=
+// pair follows it, so the commas inside Expires dates stay put.
+func SplitSetCookie(folded string) []string {
+	lines := []string{}
+	start := 0
+	for i := 0; i < len(folded); i++ {
+		if folded[i] != ',' {
+			continue
+		}
+		next := folded[i+1:]
+		if end := strings.IndexAny(next, ";,"); end >= 0 {
+			next = next[:end]
+		}
+		if strings.Contains(next, "=") {
+			lines = append(lines, strings.TrimSpace(folded[start:i]))
+			start = i + 1
+		}
+	}
+	return append(lines, strings.TrimSpace(folded[start:]))
+}
@@ -0,0 +1,184 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSetCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		cookie *Cookie
+		err    bool
+	}{
+		{
+			name:   "Name And Value",
+			line:   "session=abc123",
+			cookie: &Cookie{Name: "session", Value: "abc123"},
+		},
+		{
+			name: "All Attributes",
+			line: "id=a3fWa; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Max-Age=3600; Domain=.Example.com; Path=/docs; Secure; HttpOnly; SameSite=Strict; Partitioned",
+			cookie: &Cookie{
+				Name:        "id",
+				Value:       "a3fWa",
+				Expires:     time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC),
+				MaxAge:      3600,
+				Domain:      "example.com",
+				Path:        "/docs",
+				Secure:      true,
+				HttpOnly:    true,
+				SameSite:    SameSiteStrict,
+				Partitioned: true,
+			},
+		},
+		{
+			name:   "Quoted Value And Odd Spacing",
+			line:   ` theme = "dark" ;path=/;  secure`,
+			cookie: &Cookie{Name: "theme", Value: "dark", Path: "/", Secure: true},
+		},
+		{
+			name:   "Obsolete Date Format",
+			line:   "old=1; expires=Wednesday, 21-Oct-26 07:28:00 GMT",
+			cookie: &Cookie{Name: "old", Value: "1", Expires: time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC)},
+		},
+		{
+			name:   "Zero Max-Age Deletes",
+			line:   "gone=; Max-Age=0",
+			cookie: &Cookie{Name: "gone", MaxAge: -1},
+		},
+		{
+			name:   "Bad Attributes Are Ignored",
+			line:   "x=1; Max-Age=+5; Expires=soon; SameSite=sometimes; Flavor=mint",
+			cookie: &Cookie{Name: "x", Value: "1"},
+		},
+		{name: "No Equals Sign", line: "session", err: true},
+		{name: "Empty Name", line: "=value; Path=/", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := ParseSetCookie(tc.line)
+			if tc.err {
+				assert.ErrorIs(t, err, ErrorMalformedCookie)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.cookie, c)
+		})
+	}
+}
+
+func TestSplitSetCookie(t *testing.T) {
+	folded := "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/,b=2,c=3; HttpOnly"
+	assert.Equal(t, []string{
+		"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/",
+		"b=2",
+		"c=3; HttpOnly",
+	}, SplitSetCookie(folded))
+	assert.Equal(t, []string{"only=1"}, SplitSetCookie("only=1"))
+}
+
+func TestCookieString(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie *Cookie
+		want   string
+	}{
+		{
+			name:   "Name And Value",
+			cookie: &Cookie{Name: "session", Value: "abc123"},
+			want:   "session=abc123",
+		},
+		{
+			name: "All Attributes",
+			cookie: &Cookie{
+				Name:        "id",
+				Value:       "a3fWa",
+				Path:        "/docs",
+				Domain:      ".example.com",
+				Expires:     time.Date(2026, 10, 21, 9, 28, 0, 0, time.FixedZone("CEST", 2*60*60)),
+				MaxAge:      3600,
+				Secure:      true,
+				HttpOnly:    true,
+				SameSite:    SameSiteNone,
+				Partitioned: true,
+			},
+			want: "id=a3fWa; Path=/docs; Domain=example.com; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned",
+		},
+		{
+			name:   "Deletion",
+			cookie: &Cookie{Name: "gone", MaxAge: -1, SameSite: SameSiteLax},
+			want:   "gone=; Max-Age=0; SameSite=Lax",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.cookie.String())
+
+			// what is written reads back the same
+			parsed, err := ParseSetCookie(tc.want)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, parsed.String())
+		})
+	}
+}
+
+func TestCookieValid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie Cookie
+		valid  bool
+	}{
+		{name: "Plain", cookie: Cookie{Name: "theme", Value: "dark"}, valid: true},
+		{name: "Quoted Value", cookie: Cookie{Name: "theme", Value: `"dark"`}, valid: true},
+		{name: "Base64 Value", cookie: Cookie{Name: "sid", Value: "YWJj+/ZA=="}, valid: true},
+		{name: "IP Domain", cookie: Cookie{Name: "a", Domain: "127.0.0.1"}, valid: true},
+		{name: "Empty Name", cookie: Cookie{Value: "x"}},
+		{name: "Separator In Name", cookie: Cookie{Name: "a:b", Value: "x"}},
+		{name: "Space In Value", cookie: Cookie{Name: "a", Value: "two words"}},
+		{name: "Semicolon In Value", cookie: Cookie{Name: "a", Value: "x; Domain=evil.com"}},
+		{name: "Comma In Value", cookie: Cookie{Name: "a", Value: "1,2"}},
+		{name: "Non-ASCII Value", cookie: Cookie{Name: "a", Value: "café"}},
+		{name: "Semicolon In Path", cookie: Cookie{Name: "a", Path: "/;x"}},
+		{name: "Bad Domain", cookie: Cookie{Name: "a", Domain: "exa mple.com"}},
+		{name: "SameSite None Needs Secure", cookie: Cookie{Name: "a", SameSite: SameSiteNone}},
+		{name: "Partitioned Needs Secure", cookie: Cookie{Name: "a", Partitioned: true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cookie.Valid()
+			if tc.valid {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrorInvalidCookie)
+		})
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	h := headers.NewHeaders()
+	require.NoError(t, SetCookie(h, &Cookie{Name: "a", Value: "1", Path: "/"}))
+	require.NoError(t, SetCookie(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	assert.ErrorIs(t, SetCookie(h, &Cookie{Name: "c", Value: "3;4"}), ErrorInvalidCookie)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; HttpOnly"}, h.Values("Set-Cookie"))
+}
+
+func TestParseCookie(t *testing.T) {
+	cookies := ParseCookie(` session=abc; theme="dark";; =orphan; empty=; json={"a":1,"b":2}`)
+	assert.Equal(t, []*Cookie{
+		{Name: "session", Value: "abc"},
+		{Name: "theme", Value: "dark"},
+		{Name: "empty"},
+		{Name: "json", Value: `{"a":1,"b":2}`},
+	}, cookies)
+	assert.Empty(t, ParseCookie(""))
+}
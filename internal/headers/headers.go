@@ -43,42 +43,83 @@ func parseHeader(fieldLine []byte) (string, string, error) {
 	return string(key), string(value), nil
 }
 
+// Headers holds header fields by lowercase name. Each name keeps its field
+// lines in order: Set folds a value into the last line, the way repeated
+// fields may be combined, while Add starts a line of its own for fields
+// that cannot be combined, such as Set-Cookie.
 type Headers struct {
-	headers map[string]string
+	headers map[string][]string
 }
 
 func NewHeaders() *Headers {
 	return &Headers{
-		headers: map[string]string{},
+		headers: map[string][]string{},
 	}
 }
 
+// Get returns the value of key, its lines joined with commas
 func (h *Headers) Get(key string) (string, bool) {
-	val, ok := h.headers[strings.ToLower(key)]
-	return val, ok
+	vals, ok := h.headers[strings.ToLower(key)]
+	return strings.Join(vals, ","), ok
+}
+
+// HasToken reports whether the comma-separated list in key, over all its
+// lines, contains token, compared case-insensitively
+func (h *Headers) HasToken(key, token string) bool {
+	for _, line := range h.headers[strings.ToLower(key)] {
+		for _, t := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Values returns the separate field lines of key
+func (h *Headers) Values(key string) []string {
+	return append([]string{}, h.headers[strings.ToLower(key)]...)
 }
 
 func (h *Headers) Set(key string, val string) {
 	key = strings.ToLower(key)
-	if v, ok := h.headers[key]; ok {
-		h.headers[key] = v + "," + val
+	if vals, ok := h.headers[key]; ok {
+		vals[len(vals)-1] += "," + val
 	} else {
-		h.headers[key] = val
+		h.headers[key] = []string{val}
 	}
 }
 
+// Add adds val to key on a field line of its own
+func (h *Headers) Add(key string, val string) {
+	key = strings.ToLower(key)
+	h.headers[key] = append(h.headers[key], val)
+}
+
 func (h *Headers) Replace(key string, val string) {
 	key = strings.ToLower(key)
-	h.headers[key] = val
+	h.headers[key] = []string{val}
 }
 func (h *Headers) Delete(key string) {
 	key = strings.ToLower(key)
 	delete(h.headers, key)
 }
 
+// Clone returns a copy of h that can be modified independently
+func (h *Headers) Clone() *Headers {
+	c := NewHeaders()
+	for key, vals := range h.headers {
+		c.headers[key] = append([]string{}, vals...)
+	}
+	return c
+}
+
+// ForEach calls cb for every field line
 func (h *Headers) ForEach(cb func(key, value string)) {
-	for key, value := range h.headers {
-		cb(key, value)
+	for key, vals := range h.headers {
+		for _, value := range vals {
+			cb(key, value)
+		}
 	}
 }
 
@@ -107,7 +148,12 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 			return 0, false, errMalformedHeader
 		}
 
-		h.Set(key, val)
+		// Set-Cookie lines cannot be folded into one (RFC 9110 section 5.3)
+		if strings.EqualFold(key, "Set-Cookie") {
+			h.Add(key, val)
+		} else {
+			h.Set(key, val)
+		}
 		read += idx + len(rn)
 	}
 	return read, done, nil
@@ -37,3 +37,43 @@ func TestParse(t *testing.T) {
 	assert.Equal(t, 46, n)
 	assert.False(t, done)
 }
+
+func TestAdd(t *testing.T) {
+	headers := NewHeaders()
+	headers.Add("Set-Cookie", "a=1; Path=/")
+	headers.Add("set-cookie", "b=2")
+	headers.Set("Vary", "Accept")
+	headers.Set("Vary", "Origin")
+
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, headers.Values("SET-COOKIE"))
+	val, _ := headers.Get("Set-Cookie")
+	assert.Equal(t, "a=1; Path=/,b=2", val)
+	assert.Equal(t, []string{"Accept,Origin"}, headers.Values("Vary"))
+	assert.Empty(t, headers.Values("Missing"))
+
+	lines := []string{}
+	headers.Clone().ForEach(func(key, value string) {
+		if key == "set-cookie" {
+			lines = append(lines, value)
+		}
+	})
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, lines)
+
+	// parsed Set-Cookie lines stay apart
+	headers = NewHeaders()
+	_, done, err := headers.Parse([]byte("Set-Cookie: a=1\r\nSet-Cookie: b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT"}, headers.Values("Set-Cookie"))
+}
+
+func TestHasToken(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Connection", "keep-alive, Upgrade")
+	headers.Add("Connection", "TE")
+
+	assert.True(t, headers.HasToken("connection", "upgrade"))
+	assert.True(t, headers.HasToken("Connection", "te"))
+	assert.False(t, headers.HasToken("Connection", "close"))
+	assert.False(t, headers.HasToken("Upgrade", "websocket"))
+}
@@ -0,0 +1,285 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what every HTTP/2 client sends before its first frame
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const frameHeaderLen = 9
+
+const (
+	DefaultMaxFrameSize      = 16384
+	MaxAllowedFrameSize      = 1<<24 - 1
+	DefaultInitialWindowSize = 65535
+	maxWindowSize            = 1<<31 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+// ConnectionError ends the whole connection with a GOAWAY
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.Code, e.Reason)
+}
+
+// StreamError ends a single stream with a RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.StreamID, e.Code)
+}
+
+var ErrorFrameTooLarge = errors.New("http2: frame too large")
+
+// Frame is a single HTTP/2 frame. Payload still contains any padding and
+// priority fields; use Data and HeaderBlockFragment to get at the content.
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// ReadFrame reads one frame, rejecting payloads longer than maxSize
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	if length > maxSize {
+		return nil, ErrorFrameTooLarge
+	}
+
+	f := &Frame{
+		Type:     FrameType(hdr[3]),
+		Flags:    Flags(hdr[4]),
+		StreamID: binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff,
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes f in a single call to w
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(f.Payload))
+	length := len(f.Payload)
+	buf[0], buf[1], buf[2] = byte(length>>16), byte(length>>8), byte(length)
+	buf[3] = byte(f.Type)
+	buf[4] = byte(f.Flags)
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&0x7fffffff)
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// unpad strips the padding of DATA, HEADERS and PUSH_PROMISE payloads
+func (f *Frame) unpad() ([]byte, error) {
+	p := f.Payload
+	if !f.Flags.Has(FlagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, ConnectionError{ErrCodeProtocol, "padded frame without pad length"}
+	}
+	padLen := int(p[0])
+	if padLen >= len(p) {
+		return nil, ConnectionError{ErrCodeProtocol, "padding longer than payload"}
+	}
+	return p[1 : len(p)-padLen], nil
+}
+
+// Data returns the content of a DATA frame without padding
+func (f *Frame) Data() ([]byte, error) {
+	return f.unpad()
+}
+
+// HeaderBlockFragment returns the header block carried by a HEADERS or
+// CONTINUATION frame, without padding or priority fields
+func (f *Frame) HeaderBlockFragment() ([]byte, error) {
+	if f.Type == FrameContinuation {
+		return f.Payload, nil
+	}
+	p, err := f.unpad()
+	if err != nil {
+		return nil, err
+	}
+	if f.Flags.Has(FlagPriority) {
+		if len(p) < 5 {
+			return nil, ConnectionError{ErrCodeProtocol, "short priority fields"}
+		}
+		p = p[5:]
+	}
+	return p, nil
+}
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+func SettingsFrame(settings ...Setting) *Frame {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return &Frame{Type: FrameSettings, Payload: payload}
+}
+
+// Settings parses the payload of a SETTINGS frame
+func (f *Frame) Settings() ([]Setting, error) {
+	if len(f.Payload)%6 != 0 {
+		return nil, ConnectionError{ErrCodeFrameSize, "bad SETTINGS length"}
+	}
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(p)),
+			Value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func WindowUpdateFrame(streamID, increment uint32) *Frame {
+	return &Frame{
+		Type:     FrameWindowUpdate,
+		StreamID: streamID,
+		Payload:  binary.BigEndian.AppendUint32(nil, increment&0x7fffffff),
+	}
+}
+
+// WindowIncrement parses the payload of a WINDOW_UPDATE frame
+func (f *Frame) WindowIncrement() (uint32, error) {
+	if len(f.Payload) != 4 {
+		return 0, ConnectionError{ErrCodeFrameSize, "bad WINDOW_UPDATE length"}
+	}
+	return binary.BigEndian.Uint32(f.Payload) & 0x7fffffff, nil
+}
+
+func RSTStreamFrame(streamID uint32, code ErrCode) *Frame {
+	return &Frame{
+		Type:     FrameRSTStream,
+		StreamID: streamID,
+		Payload:  binary.BigEndian.AppendUint32(nil, uint32(code)),
+	}
+}
+
+// ErrCode parses the error code of a RST_STREAM or GOAWAY frame
+func (f *Frame) ErrCode() ErrCode {
+	switch {
+	case f.Type == FrameRSTStream && len(f.Payload) >= 4:
+		return ErrCode(binary.BigEndian.Uint32(f.Payload))
+	case f.Type == FrameGoAway && len(f.Payload) >= 8:
+		return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+	}
+	return ErrCodeProtocol
+}
+
+func GoAwayFrame(lastStreamID uint32, code ErrCode, debug []byte) *Frame {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID&0x7fffffff)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return &Frame{Type: FrameGoAway, Payload: append(payload, debug...)}
+}
+
+// LastStreamID parses the last stream identifier of a GOAWAY frame
+func (f *Frame) LastStreamID() uint32 {
+	if len(f.Payload) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(f.Payload) & 0x7fffffff
+}
@@ -0,0 +1,387 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrorCompression = errors.New("hpack: invalid header block")
+
+// ErrorHeaderListTooLarge is returned for a block that decodes to more than
+// Decoder.MaxHeaderListSize
+var ErrorHeaderListTooLarge = fmt.Errorf("%w: header list too large", ErrorCompression)
+
+// HeaderField is a single name/value pair of a header block
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are never added to a dynamic table
+	Sensitive bool
+}
+
+func (f HeaderField) size() int {
+	// RFC 7541 section 4.1
+	return len(f.Name) + len(f.Value) + 32
+}
+
+// staticTable is RFC 7541 Appendix A, index 1 first
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the FIFO of recently indexed fields, newest first
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append([]HeaderField{f}, t.entries...)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.size()
+	}
+}
+
+// DefaultHeaderTableSize is the initial SETTINGS_HEADER_TABLE_SIZE
+const DefaultHeaderTableSize = 4096
+
+// Decoder turns header blocks back into fields. One Decoder must see every
+// header block of a connection, in order, because blocks build on the
+// dynamic table left by the ones before them.
+type Decoder struct {
+	table dynamicTable
+	// allowedMaxSize is the table size limit we advertised; the peer may
+	// shrink the table below it but never grow it past
+	allowedMaxSize int
+	// MaxStringLength bounds any single name or value, 0 for no limit
+	MaxStringLength int
+	// MaxHeaderListSize bounds the decoded size of a block, counted as in
+	// SETTINGS_MAX_HEADER_LIST_SIZE, 0 for no limit. Indexed fields make a
+	// block decode to far more than its own length.
+	MaxHeaderListSize int
+}
+
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxTableSize},
+		allowedMaxSize: maxTableSize,
+	}
+}
+
+func (d *Decoder) field(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, ErrorCompression
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	index -= uint64(len(staticTable)) + 1
+	if index >= uint64(len(d.table.entries)) {
+		return HeaderField{}, ErrorCompression
+	}
+	return d.table.entries[index], nil
+}
+
+// Decode parses a complete header block
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	fields := []HeaderField{}
+	sawField := false
+	listSize := 0
+	emit := func(f HeaderField) error {
+		listSize += f.size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			return ErrorHeaderListTooLarge
+		}
+		fields = append(fields, f)
+		return nil
+	}
+
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			index, rest, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.field(index)
+			if err != nil {
+				return nil, err
+			}
+			if err := emit(HeaderField{Name: f.Name, Value: f.Value}); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			f, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+			if err := emit(f); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+
+		case b&0xe0 == 0x20:
+			// dynamic table size update, only allowed before the first field
+			if sawField {
+				return nil, ErrorCompression
+			}
+			size, rest, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, ErrorCompression
+			}
+			d.table.setMaxSize(int(size))
+			block = rest
+
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			f, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+			if err := emit(f); err != nil {
+				return nil, err
+			}
+			block = rest
+			sawField = true
+		}
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	index, rest, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	f := HeaderField{}
+	if index == 0 {
+		f.Name, rest, err = d.readString(rest)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	} else {
+		named, err := d.field(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = named.Name
+	}
+
+	f.Value, rest, err = d.readString(rest)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, ErrorCompression
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, ErrorCompression
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+
+	if !huffman {
+		if d.MaxStringLength > 0 && len(raw) > d.MaxStringLength {
+			return "", nil, ErrorCompression
+		}
+		return string(raw), rest, nil
+	}
+
+	decoded, err := huffmanDecode(raw, d.MaxStringLength)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), rest, nil
+}
+
+// Encoder produces header blocks. It never adds to the dynamic table, so
+// the peer's SETTINGS_HEADER_TABLE_SIZE never matters; fields are sent as an
+// index when the static table has them, as literals otherwise.
+type Encoder struct{}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Encode appends the header block for fields to dst
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	for _, f := range fields {
+		nameIndex := 0
+		fullIndex := 0
+		for i, s := range staticTable {
+			if s.Name != f.Name {
+				continue
+			}
+			if nameIndex == 0 {
+				nameIndex = i + 1
+			}
+			if s.Value == f.Value {
+				fullIndex = i + 1
+				break
+			}
+		}
+
+		if fullIndex != 0 && !f.Sensitive {
+			dst = appendInt(dst, 0x80, 7, uint64(fullIndex))
+			continue
+		}
+
+		first := byte(0x00)
+		if f.Sensitive {
+			first = 0x10
+		}
+		dst = appendInt(dst, first, 4, uint64(nameIndex))
+		if nameIndex == 0 {
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendString(dst, f.Value)
+	}
+	return dst
+}
+
+// readInt decodes an integer with an n-bit prefix (RFC 7541 section 5.1)
+func readInt(b []byte, n uint8) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, ErrorCompression
+	}
+	max := uint64(1)<<n - 1
+	value := uint64(b[0]) & max
+	b = b[1:]
+	if value < max {
+		return value, b, nil
+	}
+
+	shift := uint(0)
+	for len(b) > 0 {
+		c := b[0]
+		b = b[1:]
+		value += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return value, b, nil
+		}
+		shift += 7
+		if shift > 56 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrorCompression)
+		}
+	}
+	return 0, nil, ErrorCompression
+}
+
+func appendInt(dst []byte, first byte, n uint8, value uint64) []byte {
+	max := uint64(1)<<n - 1
+	if value < max {
+		return append(dst, first|byte(value))
+	}
+	dst = append(dst, first|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// appendString writes s Huffman coded when that is shorter
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLength(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
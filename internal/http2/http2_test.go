@@ -0,0 +1,500 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHuffman(t *testing.T) {
+	encoded := huffmanEncode(nil, "www.example.com")
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(encoded))
+	assert.Equal(t, len(encoded), huffmanEncodedLength("www.example.com"))
+
+	decoded, err := huffmanDecode(encoded, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", string(decoded))
+
+	// padding longer than 7 bits is an error
+	_, err = huffmanDecode(append(encoded, 0xff), 0)
+	assert.Error(t, err)
+}
+
+func TestDecoderRFCExamples(t *testing.T) {
+	// RFC 7541 appendix C.4: three requests sharing one dynamic table
+	tests := []struct {
+		name   string
+		block  string
+		fields []HeaderField
+	}{
+		{
+			name:  "First Request",
+			block: "828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			fields: []HeaderField{
+				{Name: ":method", Value: "GET"},
+				{Name: ":scheme", Value: "http"},
+				{Name: ":path", Value: "/"},
+				{Name: ":authority", Value: "www.example.com"},
+			},
+		},
+		{
+			name:  "Second Request",
+			block: "828684be5886a8eb10649cbf",
+			fields: []HeaderField{
+				{Name: ":method", Value: "GET"},
+				{Name: ":scheme", Value: "http"},
+				{Name: ":path", Value: "/"},
+				{Name: ":authority", Value: "www.example.com"},
+				{Name: "cache-control", Value: "no-cache"},
+			},
+		},
+		{
+			name:  "Third Request",
+			block: "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+			fields: []HeaderField{
+				{Name: ":method", Value: "GET"},
+				{Name: ":scheme", Value: "https"},
+				{Name: ":path", Value: "/index.html"},
+				{Name: ":authority", Value: "www.example.com"},
+				{Name: "custom-key", Value: "custom-value"},
+			},
+		},
+	}
+
+	d := NewDecoder(DefaultHeaderTableSize)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			block, err := hex.DecodeString(tc.block)
+			require.NoError(t, err)
+			fields, err := d.Decode(block)
+			require.NoError(t, err)
+			assert.Equal(t, tc.fields, fields)
+		})
+	}
+	assert.Equal(t, 164, d.table.size)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "418"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "x-custom", Value: strings.Repeat("long value ", 20)},
+	}
+
+	block := NewEncoder().Encode(nil, fields)
+	decoded, err := NewDecoder(DefaultHeaderTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	_, err = NewDecoder(DefaultHeaderTableSize).Decode([]byte{0x80})
+	assert.ErrorIs(t, err, ErrorCompression)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteFrame(buf, SettingsFrame(Setting{ID: SettingInitialWindowSize, Value: 10})))
+	// DATA with 2 bytes of padding
+	require.NoError(t, WriteFrame(buf, &Frame{Type: FrameData, Flags: FlagPadded | FlagEndStream, StreamID: 3, Payload: []byte("\x02hi\x00\x00")}))
+
+	f, err := ReadFrame(buf, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	settings, err := f.Settings()
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{ID: SettingInitialWindowSize, Value: 10}}, settings)
+
+	f, err = ReadFrame(buf, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), f.StreamID)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+	data, err := f.Data()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	require.NoError(t, WriteFrame(buf, &Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 100)}))
+	_, err = ReadFrame(buf, 50)
+	assert.ErrorIs(t, err, ErrorFrameTooLarge)
+}
+
+// testClient speaks HTTP/2 to ServeConn over an in-memory pipe
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	enc    *Encoder
+	dec    *Decoder
+	frames chan *Frame
+	served chan error
+}
+
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+	reset   bool
+}
+
+func newTestClient(t *testing.T, handler Handler, cfg Config, settings ...Setting) *testClient {
+	client, server := net.Pipe()
+	c := &testClient{
+		t:      t,
+		conn:   client,
+		enc:    NewEncoder(),
+		dec:    NewDecoder(DefaultHeaderTableSize),
+		frames: make(chan *Frame, 256),
+		served: make(chan error, 1),
+	}
+	go func() { c.served <- ServeConn(server, nil, handler, cfg) }()
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := ReadFrame(client, MaxAllowedFrameSize)
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	_, err := client.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.write(SettingsFrame(settings...))
+	return c
+}
+
+func (c *testClient) write(f *Frame) {
+	require.NoError(c.t, WriteFrame(c.conn, f))
+}
+
+func (c *testClient) request(id uint32, method, path string, endStream bool) {
+	block := c.enc.Encode(nil, []HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost"},
+	})
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.write(&Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: block})
+}
+
+// next returns the next frame that is not connection housekeeping
+func (c *testClient) next() *Frame {
+	for {
+		select {
+		case f, ok := <-c.frames:
+			require.True(c.t, ok, "connection closed")
+			if f.Type == FrameSettings || f.Type == FrameWindowUpdate {
+				continue
+			}
+			return f
+		case <-time.After(2 * time.Second):
+			c.t.Fatal("timed out waiting for a frame")
+			return nil
+		}
+	}
+}
+
+// responses reads frames until n streams have ended and returns them with
+// the order they ended in
+func (c *testClient) responses(n int) (map[uint32]*testResponse, []uint32) {
+	resps := map[uint32]*testResponse{}
+	order := []uint32{}
+	get := func(id uint32) *testResponse {
+		if resps[id] == nil {
+			resps[id] = &testResponse{headers: map[string]string{}}
+		}
+		return resps[id]
+	}
+
+	for len(order) < n {
+		f := c.next()
+		resp := get(f.StreamID)
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.dec.Decode(f.Payload)
+			require.NoError(c.t, err)
+			for _, field := range fields {
+				if field.Name == ":status" {
+					resp.status = field.Value
+				} else {
+					resp.headers[field.Name] = field.Value
+				}
+			}
+		case FrameData:
+			resp.body += string(f.Payload)
+		case FrameRSTStream:
+			resp.reset = true
+			order = append(order, f.StreamID)
+			continue
+		default:
+			continue
+		}
+		if f.Flags.Has(FlagEndStream) {
+			order = append(order, f.StreamID)
+		}
+	}
+	return resps, order
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServeConnRequests(t *testing.T) {
+	c := newTestClient(t, echoHandler, Config{})
+
+	c.request(1, "GET", "/hello", true)
+	c.request(3, "POST", "/upload", false)
+	c.write(&Frame{Type: FrameData, StreamID: 3, Payload: []byte("part one, ")})
+	c.write(&Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 3, Payload: []byte("part two")})
+
+	resps, _ := c.responses(2)
+	assert.Equal(t, "200", resps[1].status)
+	assert.Equal(t, "GET /hello ", resps[1].body)
+	assert.Equal(t, "11", resps[1].headers["content-length"])
+	// connection-specific headers have no place in HTTP/2
+	assert.NotContains(t, resps[1].headers, "connection")
+	assert.Equal(t, "POST /upload part one, part two", resps[3].body)
+}
+
+func TestServeConnMultiplexes(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		echoHandler(w, req)
+	}, Config{})
+
+	c.request(1, "GET", "/slow", true)
+	c.request(3, "GET", "/fast", true)
+
+	resps, order := c.responses(1)
+	assert.Equal(t, []uint32{3}, order)
+	assert.Equal(t, "GET /fast ", resps[3].body)
+
+	close(release)
+	resps, order = c.responses(1)
+	assert.Equal(t, []uint32{1}, order)
+	assert.Equal(t, "GET /slow ", resps[1].body)
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		body := []byte(strings.Repeat("x", 25))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, Config{}, Setting{ID: SettingInitialWindowSize, Value: 10})
+
+	c.request(1, "GET", "/", true)
+	f := c.next()
+	require.Equal(t, FrameHeaders, f.Type)
+	f = c.next()
+	require.Equal(t, FrameData, f.Type)
+	assert.Len(t, f.Payload, 10)
+
+	select {
+	case f := <-c.frames:
+		if f.Type == FrameData {
+			t.Fatal("data sent past the stream window")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.write(WindowUpdateFrame(1, 100))
+	resps, _ := c.responses(1)
+	assert.Equal(t, strings.Repeat("x", 15), resps[1].body)
+}
+
+func TestServeConnPingAndErrors(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		echoHandler(w, req)
+	}, Config{MaxBodyBytes: 4})
+
+	c.write(&Frame{Type: FramePing, Payload: []byte("12345678")})
+	f := c.next()
+	assert.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+
+	c.request(1, "GET", "/panic", true)
+	resps, _ := c.responses(1)
+	assert.Equal(t, "500", resps[1].status)
+
+	c.request(3, "POST", "/", false)
+	c.write(&Frame{Type: FrameData, StreamID: 3, Payload: []byte("too much")})
+	resps, _ = c.responses(1)
+	assert.Equal(t, "413", resps[3].status)
+}
+
+func TestServeConnGoAway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		<-release
+		echoHandler(w, req)
+	}, Config{Context: ctx})
+
+	c.request(1, "GET", "/", true)
+	// make sure the stream is open before asking the connection to go away
+	c.write(&Frame{Type: FramePing, Payload: make([]byte, 8)})
+	require.Equal(t, FramePing, c.next().Type)
+
+	cancel()
+	f := c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), f.LastStreamID())
+	assert.Equal(t, ErrCodeNo, f.ErrCode())
+
+	// streams past the last one are refused
+	c.request(3, "GET", "/", true)
+	f = c.next()
+	assert.Equal(t, FrameRSTStream, f.Type)
+	assert.Equal(t, ErrCodeRefusedStream, f.ErrCode())
+
+	close(release)
+	resps, _ := c.responses(1)
+	assert.Equal(t, "200", resps[1].status)
+
+	select {
+	case <-c.served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after its streams finished")
+	}
+}
+
+func TestServeConnShutdownKeepsContexts(t *testing.T) {
+	shutdown := make(chan struct{})
+	release := make(chan struct{})
+	ctxErr := make(chan error, 1)
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		<-release
+		ctxErr <- req.Context().Err()
+		echoHandler(w, req)
+	}, Config{Shutdown: shutdown})
+
+	c.request(1, "GET", "/", true)
+	c.write(&Frame{Type: FramePing, Payload: make([]byte, 8)})
+	require.Equal(t, FramePing, c.next().Type)
+
+	close(shutdown)
+	f := c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), f.LastStreamID())
+
+	close(release)
+	resps, _ := c.responses(1)
+	assert.Equal(t, "200", resps[1].status)
+	assert.NoError(t, <-ctxErr)
+
+	select {
+	case <-c.served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after its streams finished")
+	}
+}
+
+func TestServeConnResetCancelsContext(t *testing.T) {
+	entered := make(chan struct{})
+	causes := make(chan error, 1)
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		close(entered)
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	}, Config{})
+
+	c.request(1, "GET", "/wait", true)
+	<-entered
+	c.write(RSTStreamFrame(1, ErrCodeCancel))
+
+	select {
+	case err := <-causes:
+		assert.ErrorIs(t, err, ErrorStreamReset)
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not cancelled by RST_STREAM")
+	}
+}
+
+func TestServeConnHeaderListLimit(t *testing.T) {
+	called := false
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		called = true
+		echoHandler(w, req)
+	}, Config{MaxHeaderBytes: 64 << 10})
+
+	// one large field enters the dynamic table and is then referenced by a
+	// single byte over and over, decoding to far more than the block size
+	block := c.enc.Encode(nil, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+	})
+	block = appendInt(block, 0x40, 6, 0)
+	block = appendString(block, "x-big")
+	block = appendString(block, strings.Repeat("a", 4000))
+	block = append(block, bytes.Repeat([]byte{0xbe}, DefaultMaxFrameSize-len(block))...)
+	c.write(&Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+
+	f := c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, ErrCodeCompression, f.ErrCode())
+	assert.False(t, called)
+
+	d := NewDecoder(DefaultHeaderTableSize)
+	d.MaxHeaderListSize = 64 << 10
+	_, err := d.Decode(block)
+	assert.ErrorIs(t, err, ErrorHeaderListTooLarge)
+	assert.ErrorIs(t, err, ErrorCompression)
+}
+
+func TestServeConnReceiveWindow(t *testing.T) {
+	c := newTestClient(t, echoHandler, Config{MaxBodyBytes: DefaultInitialWindowSize})
+
+	// a body as large as the limit fits the initial window, which is
+	// never reopened since the body may not grow any further
+	c.request(1, "POST", "/", false)
+	chunk := make([]byte, DefaultMaxFrameSize-1)
+	for sent := 0; sent < DefaultInitialWindowSize; sent += len(chunk) {
+		c.write(&Frame{Type: FrameData, StreamID: 1, Payload: chunk[:min(len(chunk), DefaultInitialWindowSize-sent)]})
+	}
+	c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte("x")})
+
+	for {
+		f, ok := <-c.frames
+		require.True(t, ok, "connection closed")
+		if f.Type == FrameWindowUpdate {
+			assert.Equal(t, uint32(0), f.StreamID, "stream window reopened")
+		}
+		if f.Type == FrameSettings || f.Type == FrameWindowUpdate {
+			continue
+		}
+		require.Equal(t, FrameRSTStream, f.Type)
+		assert.Equal(t, uint32(1), f.StreamID)
+		assert.Equal(t, ErrCodeFlowControl, f.ErrCode())
+		break
+	}
+
+	// the connection is still usable
+	c.request(3, "GET", "/", true)
+	resps, _ := c.responses(1)
+	assert.Equal(t, "200", resps[3].status)
+}
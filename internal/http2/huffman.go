@@ -0,0 +1,101 @@
+package http2
+
+import "sync"
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+var (
+	huffmanRoot     *huffmanNode
+	huffmanRootOnce sync.Once
+)
+
+func huffmanTree() *huffmanNode {
+	huffmanRootOnce.Do(func() {
+		huffmanRoot = &huffmanNode{}
+		for sym, code := range huffmanCodes {
+			length := huffmanCodeLengths[sym]
+			node := huffmanRoot
+			for i := int(length) - 1; i >= 0; i-- {
+				bit := (code >> uint(i)) & 1
+				if node.children[bit] == nil {
+					node.children[bit] = &huffmanNode{}
+				}
+				node = node.children[bit]
+			}
+			node.sym = byte(sym)
+			node.leaf = true
+		}
+	})
+	return huffmanRoot
+}
+
+// huffmanDecode decodes a Huffman coded string. Padding must be the most
+// significant bits of EOS, at most 7 of them. maxLen bounds the output when
+// it is positive.
+func huffmanDecode(src []byte, maxLen int) ([]byte, error) {
+	root := huffmanTree()
+	out := []byte{}
+	node := root
+	// bits consumed since the last symbol, and whether they were all ones
+	pending := 0
+	allOnes := true
+
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			node = node.children[bit]
+			if node == nil {
+				// only EOS is longer than 30 bits, and it must not appear
+				return nil, ErrorCompression
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if node.leaf {
+				out = append(out, node.sym)
+				if maxLen > 0 && len(out) > maxLen {
+					return nil, ErrorCompression
+				}
+				node = root
+				pending = 0
+				allOnes = true
+			}
+		}
+	}
+
+	if pending > 7 || !allOnes {
+		return nil, ErrorCompression
+	}
+	return out, nil
+}
+
+func huffmanEncodedLength(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLengths[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		length := int(huffmanCodeLengths[s[i]])
+		acc = acc<<uint(length) | uint64(huffmanCodes[s[i]])
+		n += length
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>uint(n)))
+		}
+	}
+	if n > 0 {
+		// pad with the most significant bits of EOS, which are all ones
+		acc = acc<<uint(8-n) | uint64(0xff>>uint(n))
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,892 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+)
+
+// Handler has the signature of server.Handler, repeated here so this
+// package does not depend on the server that uses it
+type Handler = func(w *response.Writer, req *request.Request)
+
+const DefaultMaxConcurrentStreams = 100
+
+// DefaultMaxBodyBytes caps a buffered request body when Config.MaxBodyBytes
+// is zero
+const DefaultMaxBodyBytes = 10 << 20
+
+var ErrorBadPreface = errors.New("http2: bad client preface")
+var errStreamClosed = errors.New("http2: stream closed")
+
+// ErrorStreamReset is the cause of a request context cancelled because the
+// client reset its stream
+var ErrorStreamReset = errors.New("http2: stream reset by client")
+
+// connectionHeaders are HTTP/1.1 hop-by-hop fields HTTP/2 forbids
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+type Config struct {
+	// MaxConcurrentStreams limits the streams a client may have open,
+	// DefaultMaxConcurrentStreams when zero
+	MaxConcurrentStreams uint32
+	// MaxHeaderBytes limits the size of a header block,
+	// request.DefaultMaxHeaderBytes when zero
+	MaxHeaderBytes int
+	// MaxBodyBytes limits a request body; larger ones get a 413.
+	// DefaultMaxBodyBytes when zero. Bodies are buffered until complete, so
+	// the stream window is never opened past this limit.
+	MaxBodyBytes int
+	// IdleTimeout closes the connection after this long without open
+	// streams. Zero means no limit.
+	IdleTimeout time.Duration
+	// Logger receives recovered panics, slog.Default() when nil
+	Logger *slog.Logger
+	// Context is the parent of every request context on the connection,
+	// context.Background() when nil. Once it is cancelled the connection
+	// sends GOAWAY and closes when the streams already open have finished.
+	Context context.Context
+	// Shutdown, when closed, makes the connection send GOAWAY and close
+	// once the streams already open have finished, leaving their request
+	// contexts alone
+	Shutdown <-chan struct{}
+}
+
+type serverConn struct {
+	conn    net.Conn
+	reader  io.Reader
+	handler Handler
+	cfg     Config
+	logger  *slog.Logger
+	tls     *tls.ConnectionState
+
+	// writeMu serializes frames on the wire. The encoder is only used with
+	// it held, so header blocks reach the peer in the order they were encoded.
+	writeMu sync.Mutex
+	encoder *Encoder
+
+	// the read loop owns the decoder and the header block being assembled
+	decoder       *Decoder
+	headerStream  *stream
+	headerBlock   []byte
+	headerEnd     bool
+	continuingFor uint32
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	lastStreamID      uint32
+	goingAway         bool
+	closed            bool
+	handlers          sync.WaitGroup
+	exited            chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+type stream struct {
+	sc     *serverConn
+	id     uint32
+	req    *request.Request
+	cancel context.CancelCauseFunc
+
+	// read loop only
+	remoteDone bool
+	tooLarge   bool
+	// recvWindow is how much DATA the client may still send on the stream
+	recvWindow int64
+
+	// guarded by sc.mu
+	sendWindow int64
+	done       bool
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away, the idle
+// timeout fires or cfg.Context is cancelled or cfg.Shutdown closed. buffered holds bytes already read
+// from conn, which must start with the client preface. Each stream is
+// delivered to handler once its request body is complete.
+func ServeConn(conn net.Conn, buffered []byte, handler Handler, cfg Config) error {
+	if cfg.MaxConcurrentStreams == 0 {
+		cfg.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if cfg.MaxHeaderBytes == 0 {
+		cfg.MaxHeaderBytes = request.DefaultMaxHeaderBytes
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+
+	sc := &serverConn{
+		conn:              conn,
+		reader:            bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		handler:           handler,
+		cfg:               cfg,
+		logger:            logger,
+		encoder:           NewEncoder(),
+		decoder:           NewDecoder(DefaultHeaderTableSize),
+		streams:           map[uint32]*stream{},
+		sendWindow:        DefaultInitialWindowSize,
+		peerInitialWindow: DefaultInitialWindowSize,
+		peerMaxFrameSize:  DefaultMaxFrameSize,
+		exited:            make(chan struct{}),
+	}
+	sc.decoder.MaxStringLength = cfg.MaxHeaderBytes
+	// the limit advertised as SETTINGS_MAX_HEADER_LIST_SIZE
+	sc.decoder.MaxHeaderListSize = cfg.MaxHeaderBytes
+	sc.ctx, sc.cancel = context.WithCancelCause(cfg.Context)
+	sc.cond = sync.NewCond(&sc.mu)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sc.tls = &state
+	}
+
+	return sc.serve()
+}
+
+func (sc *serverConn) serve() error {
+	defer sc.shutdown()
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return ErrorBadPreface
+	}
+
+	settings := []Setting{
+		{ID: SettingMaxConcurrentStreams, Value: sc.cfg.MaxConcurrentStreams},
+		{ID: SettingMaxHeaderListSize, Value: uint32(sc.cfg.MaxHeaderBytes)},
+	}
+	if err := sc.writeFrame(SettingsFrame(settings...)); err != nil {
+		return err
+	}
+	go sc.watchDone()
+
+	for first := true; ; first = false {
+		sc.setIdleDeadline()
+		f, err := ReadFrame(sc.reader, DefaultMaxFrameSize)
+		if err != nil {
+			if errors.Is(err, ErrorFrameTooLarge) {
+				sc.goAway(ErrCodeFrameSize)
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				sc.goAway(ErrCodeNo)
+			}
+			return err
+		}
+
+		if first && f.Type != FrameSettings {
+			err = ConnectionError{ErrCodeProtocol, "first frame must be SETTINGS"}
+		} else {
+			err = sc.processFrame(f)
+		}
+
+		var se StreamError
+		var ce ConnectionError
+		switch {
+		case errors.As(err, &se):
+			sc.resetStream(se.StreamID, se.Code)
+		case errors.As(err, &ce):
+			sc.goAway(ce.Code)
+			return err
+		case err != nil:
+			return err
+		}
+
+		if sc.drained() {
+			return nil
+		}
+	}
+}
+
+// setIdleDeadline arms the idle timeout while no streams are open
+func (sc *serverConn) setIdleDeadline() {
+	if sc.cfg.IdleTimeout == 0 {
+		return
+	}
+	sc.mu.Lock()
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	if idle {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.cfg.IdleTimeout))
+	} else {
+		sc.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// drained reports whether a GOAWAY has been exchanged and every stream has
+// finished, so the connection can be closed
+func (sc *serverConn) drained() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goingAway && len(sc.streams) == 0
+}
+
+func (sc *serverConn) watchDone() {
+	select {
+	case <-sc.exited:
+		return
+	case <-sc.cfg.Context.Done():
+	case <-sc.cfg.Shutdown:
+	}
+	sc.goAway(ErrCodeNo)
+	if sc.drained() {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	close(sc.exited)
+	sc.cancel(errStreamClosed)
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) processFrame(f *Frame) error {
+	if sc.continuingFor != 0 && (f.Type != FrameContinuation || f.StreamID != sc.continuingFor) {
+		return ConnectionError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.Type {
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FrameData:
+		return sc.processData(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePing:
+		return sc.processPing(f)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnectionError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnectionError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize}
+		}
+		return nil
+	case FramePushPromise:
+		return ConnectionError{ErrCodeProtocol, "clients cannot push"}
+	}
+	// unknown frame types must be ignored
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *Frame) error {
+	if f.StreamID == 0 || f.StreamID%2 == 0 {
+		return ConnectionError{ErrCodeProtocol, "bad stream id for HEADERS"}
+	}
+	frag, err := f.HeaderBlockFragment()
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	switch {
+	case st != nil:
+		// trailers end the request
+		if st.remoteDone || !f.Flags.Has(FlagEndStream) {
+			return ConnectionError{ErrCodeProtocol, "HEADERS on a stream that is not expecting trailers"}
+		}
+	case f.StreamID <= lastStreamID:
+		return ConnectionError{ErrCodeStreamClosed, "HEADERS on a closed stream"}
+	default:
+		st = &stream{sc: sc, id: f.StreamID}
+		sc.mu.Lock()
+		sc.lastStreamID = f.StreamID
+		sc.mu.Unlock()
+	}
+
+	sc.headerStream = st
+	sc.headerBlock = append([]byte(nil), frag...)
+	sc.headerEnd = f.Flags.Has(FlagEndStream)
+	if !f.Flags.Has(FlagEndHeaders) {
+		sc.continuingFor = f.StreamID
+		return nil
+	}
+	return sc.endHeaders()
+}
+
+func (sc *serverConn) processContinuation(f *Frame) error {
+	if sc.continuingFor == 0 {
+		return ConnectionError{ErrCodeProtocol, "unexpected CONTINUATION"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.Payload...)
+	if len(sc.headerBlock) > sc.cfg.MaxHeaderBytes {
+		return ConnectionError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	if !f.Flags.Has(FlagEndHeaders) {
+		return nil
+	}
+	sc.continuingFor = 0
+	return sc.endHeaders()
+}
+
+// endHeaders decodes a complete header block. It always runs the decoder,
+// even for streams that are refused, to keep the HPACK state in sync.
+func (sc *serverConn) endHeaders() error {
+	st := sc.headerStream
+	block := sc.headerBlock
+	endStream := sc.headerEnd
+	sc.headerStream, sc.headerBlock = nil, nil
+
+	fields, err := sc.decoder.Decode(block)
+	if err != nil {
+		return ConnectionError{ErrCodeCompression, err.Error()}
+	}
+
+	if st.req != nil {
+		// trailers carry nothing handlers can see today
+		return sc.endRequest(st)
+	}
+
+	sc.mu.Lock()
+	refused := sc.goingAway || uint32(len(sc.streams)) >= sc.cfg.MaxConcurrentStreams
+	sc.mu.Unlock()
+	if refused {
+		return StreamError{st.id, ErrCodeRefusedStream}
+	}
+
+	req, err := buildRequest(fields)
+	if err != nil {
+		return StreamError{st.id, ErrCodeProtocol}
+	}
+	req.TLS = sc.tls
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	ctx, cancel := context.WithCancelCause(sc.ctx)
+	st.req = req.WithContext(ctx)
+	st.cancel = cancel
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	st.recvWindow = DefaultInitialWindowSize
+	sc.streams[st.id] = st
+	sc.mu.Unlock()
+
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func buildRequest(fields []HeaderField) (*request.Request, error) {
+	req := request.NewRequest()
+	pseudo := map[string]string{}
+	cookies := []string{}
+	regular := false
+
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			switch f.Name {
+			case ":method", ":path", ":scheme", ":authority":
+			default:
+				return nil, errors.New("unknown pseudo-header")
+			}
+			if _, dup := pseudo[f.Name]; dup || regular {
+				return nil, errors.New("misplaced pseudo-header")
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+
+		regular = true
+		if strings.ToLower(f.Name) != f.Name || connectionHeaders[f.Name] {
+			return nil, errors.New("malformed header field")
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, errors.New("malformed te header")
+		}
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+
+	method := pseudo[":method"]
+	if method == "" {
+		return nil, errors.New("missing :method")
+	}
+	if method != "CONNECT" && (pseudo[":path"] == "" || pseudo[":scheme"] == "") {
+		return nil, errors.New("missing :path or :scheme")
+	}
+	if len(cookies) > 0 {
+		req.Headers.Set("cookie", strings.Join(cookies, "; "))
+	}
+	if authority := pseudo[":authority"]; authority != "" {
+		if _, ok := req.Headers.Get("host"); !ok {
+			req.Headers.Set("host", authority)
+		}
+	}
+
+	req.RequestLine = request.RequestLine{
+		Method:        method,
+		RequestTarget: pseudo[":path"],
+		HttpVersion:   "2",
+	}
+	return req, nil
+}
+
+func (sc *serverConn) processData(f *Frame) error {
+	if f.StreamID == 0 {
+		return ConnectionError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	data, err := f.Data()
+	if err != nil {
+		return err
+	}
+
+	// data is either dropped or buffered within a stream's window, so the
+	// connection window is handed straight back
+	if len(f.Payload) > 0 {
+		if err := sc.writeFrame(WindowUpdateFrame(0, uint32(len(f.Payload)))); err != nil {
+			return err
+		}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	if st == nil || st.remoteDone {
+		if f.StreamID > lastStreamID {
+			return ConnectionError{ErrCodeProtocol, "DATA on an idle stream"}
+		}
+		return StreamError{f.StreamID, ErrCodeStreamClosed}
+	}
+	if int64(len(f.Payload)) > st.recvWindow {
+		return StreamError{st.id, ErrCodeFlowControl}
+	}
+	st.recvWindow -= int64(len(f.Payload))
+
+	st.req.Body = append(st.req.Body, data...)
+	if len(st.req.Body) > sc.cfg.MaxBodyBytes {
+		st.tooLarge = true
+		st.req.Body = nil
+		return sc.endRequest(st)
+	}
+
+	if f.Flags.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	// the window is reopened only as far as the body may still grow
+	refund := min(int64(len(f.Payload)), int64(sc.cfg.MaxBodyBytes-len(st.req.Body))-st.recvWindow)
+	if refund > 0 {
+		st.recvWindow += refund
+		return sc.writeFrame(WindowUpdateFrame(st.id, uint32(refund)))
+	}
+	return nil
+}
+
+// endRequest runs the handler for a stream whose request is complete
+func (sc *serverConn) endRequest(st *stream) error {
+	st.remoteDone = true
+
+	if !st.tooLarge {
+		if length, ok := st.req.Headers.Get("content-length"); ok {
+			if n, err := strconv.Atoi(length); err != nil || n != len(st.req.Body) {
+				return StreamError{st.id, ErrCodeProtocol}
+			}
+		}
+	}
+
+	sc.handlers.Add(1)
+	go sc.runHandler(st)
+	return nil
+}
+
+func (sc *serverConn) runHandler(st *stream) {
+	defer sc.handlers.Done()
+	defer sc.closeStream(st)
+	defer st.req.RemoveForm()
+
+	w := response.NewSenderWriter(st)
+	defer func() {
+		if v := recover(); v != nil {
+			sc.logger.Error("panic serving stream",
+				"panic", v,
+				"stream", st.id,
+				"method", st.req.RequestLine.Method,
+				"target", st.req.RequestLine.RequestTarget,
+				"stack", string(debug.Stack()),
+			)
+			if w.StatusCode() != 0 {
+				sc.resetStream(st.id, ErrCodeInternal)
+				return
+			}
+			writeStatus(w, response.StatusInternalServerError, "internal server error")
+		}
+	}()
+
+	if st.tooLarge {
+		writeStatus(w, response.StatusPayloadTooLarge, "request body too large")
+		// the client may still be sending; tell it to stop
+		sc.resetStream(st.id, ErrCodeNo)
+		return
+	}
+
+	sc.handler(w, st.req)
+	w.Finish()
+	if w.StatusCode() == 0 {
+		// the handler wrote nothing at all
+		sc.resetStream(st.id, ErrCodeInternal)
+	}
+}
+
+func writeStatus(w *response.Writer, status response.StatusCode, message string) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(message)))
+	w.WriteBody([]byte(message))
+	w.Finish()
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st.done = true
+	st.cancel(errStreamClosed)
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+	if sc.goingAway && len(sc.streams) == 0 {
+		// unblocks the read loop so the connection can end
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) processSettings(f *Frame) error {
+	if f.StreamID != 0 {
+		return ConnectionError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnectionError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+
+	settings, err := f.Settings()
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				sc.mu.Unlock()
+				return ConnectionError{ErrCodeFlowControl, "initial window too large"}
+			}
+			delta := int64(s.Value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+			}
+			sc.peerInitialWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			if s.Value < DefaultMaxFrameSize || s.Value > MaxAllowedFrameSize {
+				sc.mu.Unlock()
+				return ConnectionError{ErrCodeProtocol, "bad max frame size"}
+			}
+			sc.peerMaxFrameSize = s.Value
+		case SettingEnablePush:
+			if s.Value > 1 {
+				sc.mu.Unlock()
+				return ConnectionError{ErrCodeProtocol, "bad enable push"}
+			}
+		}
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	return sc.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) processPing(f *Frame) error {
+	if f.StreamID != 0 {
+		return ConnectionError{ErrCodeProtocol, "PING on a stream"}
+	}
+	if len(f.Payload) != 8 {
+		return ConnectionError{ErrCodeFrameSize, "bad PING length"}
+	}
+	if f.Flags.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(&Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+}
+
+func (sc *serverConn) processWindowUpdate(f *Frame) error {
+	increment, err := f.WindowIncrement()
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{ErrCodeProtocol, "zero window increment"}
+		}
+		sc.sendWindow += int64(increment)
+		if sc.sendWindow > maxWindowSize {
+			return ConnectionError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol}
+	}
+	st.sendWindow += int64(increment)
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *Frame) error {
+	if f.StreamID == 0 {
+		return ConnectionError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnectionError{ErrCodeFrameSize, "bad RST_STREAM length"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID > sc.lastStreamID {
+		return ConnectionError{ErrCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	if st := sc.streams[f.StreamID]; st != nil {
+		st.done = true
+		st.remoteDone = true
+		st.cancel(ErrorStreamReset)
+		delete(sc.streams, f.StreamID)
+		sc.cond.Broadcast()
+	}
+	return nil
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		st.done = true
+		st.cancel(errStreamClosed)
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+
+	sc.writeFrame(RSTStreamFrame(id, code))
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	sc.goingAway = true
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	sc.writeFrame(GoAwayFrame(lastStreamID, code, nil))
+}
+
+func (sc *serverConn) writeFrame(f *Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return WriteFrame(sc.conn, f)
+}
+
+// streamFrames writes the frames built by build for st unless the stream is
+// already finished. endStream marks the stream finished once they are out.
+// build runs with writeMu held so header blocks are encoded in wire order.
+func (sc *serverConn) streamFrames(st *stream, endStream bool, build func() []*Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	sc.mu.Lock()
+	done := st.done || sc.closed
+	if endStream {
+		st.done = true
+	}
+	sc.mu.Unlock()
+	if done {
+		return errStreamClosed
+	}
+
+	for _, f := range build() {
+		if err := WriteFrame(sc.conn, f); err != nil {
+			st.cancel(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveWindow blocks until the stream and connection windows allow some
+// data to be sent and returns how many bytes, at most want, may go out
+func (sc *serverConn) reserveWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		if sc.closed || st.done {
+			return 0, errStreamClosed
+		}
+		n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// SendHeaders implements response.Sender
+func (st *stream) SendHeaders(status response.StatusCode, h *headers.Headers) error {
+	fields := []HeaderField{{Name: ":status", Value: strconv.Itoa(int(status))}}
+	fields = appendFields(fields, h)
+	return st.sendHeaderBlock(fields, false)
+}
+
+// SendTrailers implements response.Sender
+func (st *stream) SendTrailers(h *headers.Headers) error {
+	fields := appendFields(nil, h)
+	if len(fields) == 0 {
+		return st.Close()
+	}
+	return st.sendHeaderBlock(fields, true)
+}
+
+// SendData implements response.Sender
+func (st *stream) SendData(p []byte) (int, error) {
+	sent := 0
+	for sent < len(p) {
+		n, err := st.sc.reserveWindow(st, len(p)-sent)
+		if err != nil {
+			return sent, err
+		}
+		f := &Frame{Type: FrameData, StreamID: st.id, Payload: p[sent : sent+n]}
+		if err := st.sc.streamFrames(st, false, func() []*Frame { return []*Frame{f} }); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// Close implements response.Sender
+func (st *stream) Close() error {
+	f := &Frame{Type: FrameData, Flags: FlagEndStream, StreamID: st.id}
+	err := st.sc.streamFrames(st, true, func() []*Frame { return []*Frame{f} })
+	if errors.Is(err, errStreamClosed) {
+		return nil
+	}
+	return err
+}
+
+// Abort implements response.Sender
+func (st *stream) Abort() error {
+	st.sc.resetStream(st.id, ErrCodeInternal)
+	return nil
+}
+
+func (st *stream) sendHeaderBlock(fields []HeaderField, endStream bool) error {
+	sc := st.sc
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	return sc.streamFrames(st, endStream, func() []*Frame {
+		block := sc.encoder.Encode(nil, fields)
+		frames := []*Frame{}
+		for first := true; first || len(block) > 0; first = false {
+			n := min(len(block), maxFrame)
+			f := &Frame{Type: FrameContinuation, StreamID: st.id, Payload: block[:n]}
+			if first {
+				f.Type = FrameHeaders
+				if endStream {
+					f.Flags |= FlagEndStream
+				}
+			}
+			block = block[n:]
+			if len(block) == 0 {
+				f.Flags |= FlagEndHeaders
+			}
+			frames = append(frames, f)
+		}
+		return frames
+	})
+}
+
+func appendFields(fields []HeaderField, h *headers.Headers) []HeaderField {
+	h.ForEach(func(key, value string) {
+		key = strings.ToLower(key)
+		if connectionHeaders[key] || strings.HasPrefix(key, ":") {
+			return
+		}
+		fields = append(fields, HeaderField{Name: key, Value: value})
+	})
+	return fields
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+// Logger logs one line per request once the handler has finished, with the
+// status code and number of body bytes it sent.
+func Logger(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			logger.Info("request",
+				"method", req.RequestLine.Method,
+				"target", req.RequestLine.RequestTarget,
+				"status", int(w.StatusCode()),
+				"bytes", w.BytesWritten(),
+				"duration", time.Since(start),
+			)
+		}
+	}
+}
+
+// Recover turns a panic in the handlers it wraps into a logged error. The
+// client gets a 500 if nothing was written yet; a partly written response
+// cannot be repaired and is aborted instead. Used per route, it keeps a
+// panic from reaching the server's own recovery.
+func Recover(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				logger.Error("panic serving request",
+					"panic", v,
+					"method", req.RequestLine.Method,
+					"target", req.RequestLine.RequestTarget,
+					"stack", string(debug.Stack()),
+				)
+				switch {
+				case w.Hijacked():
+				case w.StatusCode() != 0:
+					w.Abort()
+				default:
+					server.HandlerError{StatusCode: response.StatusInternalServerError, Message: "internal server error"}.Write(w)
+				}
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// BasicAuth rejects requests whose Authorization header does not carry
+// credentials accepted by valid, answering 401 with a challenge for realm.
+func BasicAuth(realm string, valid func(user, pass string) bool) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			user, pass, ok := basicCredentials(req, "Authorization")
+			if ok && valid(user, pass) {
+				next(w, req)
+				return
+			}
+
+			body := []byte("unauthorized")
+			w.WriteStatusLine(response.StatusUnauthorized)
+			h := response.GetDefaultHeaders(len(body))
+			h.Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			w.WriteHeaders(*h)
+			w.WriteBody(body)
+		}
+	}
+}
+
+// ProxyAuth is BasicAuth for proxies: credentials come from
+// Proxy-Authorization and failures are answered with 407 and a
+// Proxy-Authenticate challenge.
+func ProxyAuth(realm string, valid func(user, pass string) bool) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			user, pass, ok := basicCredentials(req, "Proxy-Authorization")
+			if ok && valid(user, pass) {
+				next(w, req)
+				return
+			}
+
+			body := []byte("proxy authentication required")
+			w.WriteStatusLine(response.StatusProxyAuthRequired)
+			h := response.GetDefaultHeaders(len(body))
+			h.Set("Proxy-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			w.WriteHeaders(*h)
+			w.WriteBody(body)
+		}
+	}
+}
+
+// StaticCredentials is a BasicAuth or ProxyAuth validator for a single user
+func StaticCredentials(user, pass string) func(string, string) bool {
+	return func(u, p string) bool {
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		return userOK && passOK
+	}
+}
+
+func basicCredentials(req *request.Request, header string) (string, string, bool) {
+	auth, ok := req.Headers.Get(header)
+	if !ok {
+		return "", "", false
+	}
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
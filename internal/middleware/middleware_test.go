@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func hello(w *response.Writer, r *request.Request) {
+	body := []byte("hello")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func serve(t *testing.T, h server.Handler, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bufferCloser{}
+	h(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func TestChainOrder(t *testing.T) {
+	calls := []string{}
+	trace := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, r *request.Request) {
+				calls = append(calls, name+" in")
+				next(w, r)
+				calls = append(calls, name+" out")
+			}
+		}
+	}
+
+	h := server.Chain(hello, trace("outer"), trace("inner"))
+	serve(t, h, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	assert.Equal(t, []string{"outer in", "inner in", "inner out", "outer out"}, calls)
+}
+
+func TestLoggerSeesStatusAndBytes(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	serve(t, Logger(logger)(hello), "GET /greet HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	assert.Contains(t, logs.String(), "method=GET")
+	assert.Contains(t, logs.String(), "target=/greet")
+	assert.Contains(t, logs.String(), "status=200")
+	assert.Contains(t, logs.String(), "bytes=5")
+}
+
+// closeRecorder notes whether the response was cut off
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+	mw := Recover(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	out := serve(t, mw(func(w *response.Writer, r *request.Request) {
+		panic("boom")
+	}), "GET /fail HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "internal server error"), out)
+	assert.Contains(t, logs.String(), "panic=boom")
+	assert.Contains(t, logs.String(), "target=/fail")
+
+	// a response already under way is aborted rather than finished
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	rec := &closeRecorder{}
+	w := response.NewWriter(rec)
+	mw(func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(100))
+		w.WriteBody([]byte("partial"))
+		panic("halfway")
+	})(w, req)
+	assert.True(t, rec.closed)
+	assert.NotContains(t, rec.String(), "500")
+	_, err = w.WriteBody([]byte("more"))
+	assert.ErrorIs(t, err, response.ErrorAborted)
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := BasicAuth("admin", StaticCredentials("amiyo", "s3cret"))(hello)
+	creds := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	testCases := []struct {
+		name           string
+		authorization  string
+		expectedStatus string
+	}{
+		{name: "missing", authorization: "", expectedStatus: "401"},
+		{name: "wrong password", authorization: "Basic " + creds("amiyo:nope"), expectedStatus: "401"},
+		{name: "wrong scheme", authorization: "Bearer " + creds("amiyo:s3cret"), expectedStatus: "401"},
+		{name: "valid", authorization: "Basic " + creds("amiyo:s3cret"), expectedStatus: "200"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+			if tc.authorization != "" {
+				raw += "Authorization: " + tc.authorization + "\r\n"
+			}
+			out := serve(t, h, raw+"\r\n")
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 "+tc.expectedStatus+" "), out)
+			if tc.expectedStatus == "401" {
+				assert.Contains(t, out, `www-authenticate: Basic realm="admin"`)
+			}
+		})
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	h := ProxyAuth("egress", StaticCredentials("ci", "s3cret"))(hello)
+	creds := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	testCases := []struct {
+		name           string
+		header         string
+		expectedStatus string
+	}{
+		{name: "missing", header: "", expectedStatus: "407"},
+		{name: "origin credentials", header: "Authorization: Basic " + creds("ci:s3cret"), expectedStatus: "407"},
+		{name: "wrong password", header: "Proxy-Authorization: Basic " + creds("ci:nope"), expectedStatus: "407"},
+		{name: "valid", header: "Proxy-Authorization: Basic " + creds("ci:s3cret"), expectedStatus: "200"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"
+			if tc.header != "" {
+				raw += tc.header + "\r\n"
+			}
+			out := serve(t, h, raw+"\r\n")
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 "+tc.expectedStatus+" "), out)
+			if tc.expectedStatus == "407" {
+				assert.Contains(t, out, `proxy-authenticate: Basic realm="egress"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/client"
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+var ErrorDestinationDenied = fmt.Errorf("proxy: destination not allowed")
+
+// ForwardProxy lets clients use the server as their HTTP proxy. Requests
+// with an absolute-form target are forwarded to the host they name and
+// CONNECT opens a TCP tunnel. Destinations are checked against the allow
+// and deny lists after name resolution, and only addresses that passed
+// the check are dialed. Put middleware.ProxyAuth in front of Serve to
+// require credentials.
+type ForwardProxy struct {
+	// Proxy holds the settings for forwarded requests. Its Target, Client,
+	// StripPrefix and PreserveHost are not used.
+	Proxy ReverseProxy
+
+	allow []rule
+	deny  []rule
+	// client keeps connections to destinations open between requests and
+	// dials only addresses the lists allow
+	client *client.Client
+}
+
+// NewForwardProxy returns a forward proxy. Entries of allow and deny are
+// host names ("example.com"), wildcards ("*.example.com"), addresses or
+// CIDR prefixes ("10.0.0.0/8"), each optionally followed by ":port". Host
+// names only match the name the client asked for, so use prefixes to keep
+// clients away from networks. Deny wins over allow; an empty allow list
+// allows everything not denied.
+func NewForwardProxy(allow, deny []string) (*ForwardProxy, error) {
+	f := &ForwardProxy{}
+	f.client = &client.Client{Dial: f.dial}
+	for _, s := range allow {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, r)
+	}
+	return f, nil
+}
+
+// Serve is a server.Handler for proxy requests
+func (f *ForwardProxy) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == "CONNECT" {
+		f.tunnel(w, req)
+		return
+	}
+
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || !target.IsAbs() || target.Host == "" {
+		server.HandlerError{StatusCode: response.StatusBadRequest, Message: "proxy requests need an absolute-form target"}.Write(w)
+		return
+	}
+	if _, err := f.resolve(req.Context(), client.HostPort(target)); err != nil {
+		f.reject(w, req, target.Host, err)
+		return
+	}
+
+	p := f.Proxy
+	p.Target = &url.URL{Scheme: target.Scheme, Host: target.Host}
+	p.StripPrefix = ""
+	p.PreserveHost = false
+	p.Client = f.client
+	p.Serve(w, req)
+
+	f.Proxy.logger().Info("proxy request",
+		"client", req.RemoteAddr,
+		"method", req.RequestLine.Method,
+		"destination", target.Host,
+		"status", int(w.StatusCode()),
+		"bytes", w.BytesWritten(),
+	)
+}
+
+// tunnel answers CONNECT with a 200 and then copies bytes both ways until
+// both sides are done. The tunnel outlives the request context, whose
+// write timeout is meant for ordinary responses.
+func (f *ForwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	dest := req.RequestLine.RequestTarget
+	addrs, err := f.resolve(req.Context(), dest)
+	if err != nil {
+		f.reject(w, req, dest, err)
+		return
+	}
+	upstream, err := dialFirst(req.Context(), "tcp", addrs)
+	if err != nil {
+		f.Proxy.fail(w, req, err)
+		return
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		server.HandlerError{StatusCode: response.StatusBadRequest, Message: "CONNECT needs HTTP/1.1"}.Write(w)
+		return
+	}
+	defer conn.Close()
+
+	hw := response.NewWriter(conn)
+	hw.WriteStatusLine(response.StatusOK)
+	if err := hw.WriteHeaders(*headers.NewHeaders()); err != nil {
+		return
+	}
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	start := time.Now()
+	up, down := splice(conn, upstream)
+	f.Proxy.logger().Info("tunnel closed",
+		"client", req.RemoteAddr,
+		"destination", dest,
+		"bytes_up", up+int64(len(buffered)),
+		"bytes_down", down,
+		"duration", time.Since(start),
+	)
+}
+
+// splice copies between client and upstream in both directions. When one
+// side stops sending the other gets a half-close, so protocols that wait
+// for EOF still see it; an error tears both connections down.
+func splice(client, upstream net.Conn) (up, down int64) {
+	copyHalf := func(dst, src net.Conn, n *int64) {
+		var err error
+		*n, err = io.Copy(dst, src)
+		if err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		copyHalf(client, upstream, &down)
+	}()
+	copyHalf(upstream, client, &up)
+	wg.Wait()
+	return up, down
+}
+
+// reject answers a request whose destination cannot be used: 403 when the
+// lists forbid it, 502 when its name does not resolve
+func (f *ForwardProxy) reject(w *response.Writer, req *request.Request, dest string, err error) {
+	herr := server.HandlerError{StatusCode: response.StatusBadGateway, Message: "bad gateway"}
+	if errors.Is(err, ErrorDestinationDenied) {
+		herr = server.HandlerError{StatusCode: response.StatusForbidden, Message: "destination not allowed"}
+	}
+	f.Proxy.logger().Warn("proxy request refused",
+		"client", req.RemoteAddr,
+		"method", req.RequestLine.Method,
+		"destination", dest,
+		"err", err,
+	)
+	herr.Write(w)
+}
+
+// resolve looks up the host of addr and returns the addresses, with the
+// port of addr, that the lists allow
+func (f *ForwardProxy) resolve(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addrs := []string{}
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if f.permitted(host, ip, port) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ErrorDestinationDenied
+	}
+	return addrs, nil
+}
+
+func (f *ForwardProxy) permitted(host string, ip netip.Addr, port string) bool {
+	for _, r := range f.deny {
+		if r.match(host, ip, port) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, r := range f.allow {
+		if r.match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to addr through the first of the addresses its host
+// resolves to that the lists allow and that answers
+func (f *ForwardProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	addrs, err := f.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialFirst(ctx, network, addrs)
+}
+
+func dialFirst(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: DefaultDialTimeout}
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// rule is one entry of an allow or deny list: a host name pattern or an
+// address prefix, optionally limited to a port
+type rule struct {
+	name   string
+	prefix netip.Prefix
+	port   string
+}
+
+func parseRule(s string) (rule, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	r := rule{}
+	host := s
+	if h, port, err := net.SplitHostPort(s); err == nil {
+		host, r.port = h, port
+	}
+
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		r.prefix = prefix.Masked()
+		return r, nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		r.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		return r, nil
+	}
+	if host == "" || strings.ContainsAny(host, "/:[] ") {
+		return rule{}, fmt.Errorf("proxy: bad destination rule %q", s)
+	}
+	r.name = strings.TrimSuffix(host, ".")
+	return r, nil
+}
+
+func (r rule) match(host string, ip netip.Addr, port string) bool {
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if r.name == "" {
+		return r.prefix.Contains(ip)
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if wildcard, ok := strings.CutPrefix(r.name, "*."); ok {
+		return strings.HasSuffix(host, "."+wildcard)
+	}
+	return host == r.name
+}
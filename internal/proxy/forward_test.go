@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/middleware"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newForward(t *testing.T, allow, deny []string) *ForwardProxy {
+	f, err := NewForwardProxy(allow, deny)
+	require.NoError(t, err)
+	return f
+}
+
+// proxyClient returns a client that sends everything through the proxy at
+// base, trusting the certificates of upstream when it is a TLS server
+func proxyClient(t *testing.T, base string, upstream *httptest.Server) *http.Client {
+	proxyURL, err := url.Parse(base)
+	require.NoError(t, err)
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	if upstream != nil && upstream.TLS != nil {
+		transport.TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/coffee?roast=dark", r.URL.RequestURI())
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+		w.Write([]byte("brewed"))
+	}))
+	defer upstream.Close()
+
+	base := startProxy(t, newForward(t, nil, nil).Serve)
+	client := proxyClient(t, base, nil)
+
+	req, err := http.NewRequest("GET", upstream.URL+"/coffee?roast=dark", nil)
+	require.NoError(t, err)
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "brewed", string(body))
+}
+
+func TestForwardRejectsOriginForm(t *testing.T) {
+	base := startProxy(t, newForward(t, nil, nil).Serve)
+	res, err := http.Get(base + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestConnectTunnel(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer upstream.Close()
+
+	base := startProxy(t, newForward(t, nil, nil).Serve)
+	client := proxyClient(t, base, upstream)
+
+	for range 2 {
+		res, err := client.Get(upstream.URL + "/")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "secret", string(body))
+	}
+}
+
+func TestConnectHalfClose(t *testing.T) {
+	// an upstream that answers only once the client has finished sending
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write([]byte(strings.ToUpper(string(data))))
+	}()
+
+	base := startProxy(t, newForward(t, nil, nil).Serve)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// the tunnel data rides along with the CONNECT request
+	dest := l.Addr().String()
+	_, err = conn.Write([]byte("CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n\r\nhello"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = conn.Write([]byte(" tunnel"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO TUNNEL", string(rest))
+}
+
+func TestDestinationLists(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsUpstream.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed bool
+		tunnel  bool
+	}{
+		{name: "No Lists", allowed: true, tunnel: true},
+		{name: "Denied Prefix", deny: []string{"127.0.0.0/8"}},
+		{name: "Allowed Prefix", allow: []string{"127.0.0.0/8"}, allowed: true, tunnel: true},
+		{name: "Deny Wins", allow: []string{"127.0.0.0/8"}, deny: []string{"127.0.0.1"}},
+		{name: "Not Allowed", allow: []string{"*.example.com"}},
+		{name: "Other Port", allow: []string{"127.0.0.1:1"}},
+		// the TLS upstream listens on another port
+		{name: "Allowed Port", allow: []string{"127.0.0.1:" + port}, allowed: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base := startProxy(t, newForward(t, tc.allow, tc.deny).Serve)
+
+			res, err := proxyClient(t, base, nil).Get(upstream.URL + "/")
+			require.NoError(t, err)
+			res.Body.Close()
+			if tc.allowed {
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusForbidden, res.StatusCode)
+			}
+
+			// CONNECT goes through the same lists
+			res, err = proxyClient(t, base, tlsUpstream).Get(tlsUpstream.URL + "/")
+			if tc.tunnel {
+				require.NoError(t, err)
+				res.Body.Close()
+			} else {
+				assert.ErrorContains(t, err, "Forbidden")
+			}
+		})
+	}
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer upstream.Close()
+
+	f := newForward(t, nil, nil)
+	base := startProxy(t, server.Chain(f.Serve, middleware.ProxyAuth("egress", middleware.StaticCredentials("ci", "s3cret"))))
+
+	res, err := proxyClient(t, base, nil).Get(upstream.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Proxy-Authenticate"), `realm="egress"`)
+
+	authed := strings.Replace(base, "http://", "http://ci:s3cret@", 1)
+	res, err = proxyClient(t, authed, nil).Get(upstream.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		host  string
+		ip    string
+		port  string
+		match bool
+		err   bool
+	}{
+		{name: "Exact Name", rule: "example.com", host: "EXAMPLE.com.", port: "80", match: true},
+		{name: "Wildcard", rule: "*.example.com", host: "api.example.com", port: "443", match: true},
+		{name: "Wildcard Skips Apex", rule: "*.example.com", host: "example.com", port: "443"},
+		{name: "Prefix", rule: "10.0.0.0/8", host: "internal", ip: "10.1.2.3", port: "80", match: true},
+		{name: "Prefix With Port", rule: "10.0.0.0/8:22", host: "internal", ip: "10.1.2.3", port: "80"},
+		{name: "IPv6 Address", rule: "[::1]:443", host: "::1", ip: "::1", port: "443", match: true},
+		{name: "Empty", rule: " ", err: true},
+		{name: "Garbage", rule: "exa mple.com", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := parseRule(tc.rule)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			ip, _ := netip.ParseAddr(tc.ip)
+			assert.Equal(t, tc.match, r.match(tc.host, ip, tc.port))
+		})
+	}
+}
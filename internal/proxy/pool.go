@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/client"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+type Strategy int
+
+const (
+	// RoundRobin sends requests to each backend in turn
+	RoundRobin Strategy = iota
+	// LeastConnections picks the backend with the fewest requests in flight
+	LeastConnections
+	// ConsistentHash sends requests with the same key to the same backend,
+	// moving only that backend's keys when it goes down
+	ConsistentHash
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultMaxFails            = 3
+	DefaultFailTimeout         = 10 * time.Second
+)
+
+// ringReplicas is the number of points each backend gets on the hash ring
+const ringReplicas = 100
+
+// Backend is one upstream of a Pool
+type Backend struct {
+	URL *url.URL
+
+	active    atomic.Int64
+	failures  atomic.Int32
+	downUntil atomic.Int64
+}
+
+// Healthy reports whether the backend is taking requests
+func (b *Backend) Healthy() bool {
+	return time.Now().UnixNano() >= b.downUntil.Load()
+}
+
+// ActiveRequests returns the number of requests in flight to the backend
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+// Pool balances requests across several upstreams. Backends are taken out
+// passively after MaxFails consecutive connection failures, and actively
+// by health checks once StartHealthChecks is called.
+type Pool struct {
+	Strategy Strategy
+	// HashHeader names the header ConsistentHash keys on. The client IP is
+	// used when it is empty or the request does not carry the header.
+	HashHeader string
+	// Retries is how many other backends an idempotent request is tried
+	// on when a backend cannot be reached. Other requests are never
+	// retried.
+	Retries int
+
+	// HealthCheckPath is requested with GET on every backend; any status
+	// below 400 counts as healthy. Active checks are off when it is empty.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// MaxFails consecutive failures take a backend out for FailTimeout
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// Proxy holds the forwarding settings shared by every backend. Its
+	// Target is not used.
+	Proxy ReverseProxy
+
+	backends []*Backend
+	ring     []ringPoint
+	next     atomic.Uint64
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPool returns a round-robin pool over targets
+func NewPool(targets ...string) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("proxy: pool needs at least one target")
+	}
+	p := &Pool{}
+	for _, target := range targets {
+		rp, err := New(target)
+		if err != nil {
+			return nil, err
+		}
+		b := &Backend{URL: rp.Target}
+		p.backends = append(p.backends, b)
+		for i := range ringReplicas {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(target + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return p, nil
+}
+
+// Backends returns the pool's backends in the order they were given
+func (p *Pool) Backends() []*Backend {
+	return slices.Clone(p.backends)
+}
+
+// Serve is a server.Handler that forwards req to one of the backends
+func (p *Pool) Serve(w *response.Writer, req *request.Request) {
+	ctx := req.Context()
+	attempts := 1
+	if client.Idempotent(req.RequestLine.Method) {
+		attempts += p.Retries
+	}
+
+	tried := map[*Backend]bool{}
+	var err error
+	for range attempts {
+		b := p.pick(req, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		b.active.Add(1)
+		var res *response.Response
+		res, err = p.Proxy.roundTrip(ctx, b.URL, req)
+		if err != nil {
+			b.active.Add(-1)
+			if ctx.Err() != nil {
+				break
+			}
+			p.markFailed(b, err)
+			continue
+		}
+		b.failures.Store(0)
+		p.Proxy.relay(w, req, res)
+		res.Body.Close()
+		b.active.Add(-1)
+		return
+	}
+
+	if err == nil {
+		p.Proxy.logger().Warn("no backend available", "target", req.RequestLine.RequestTarget)
+		server.HandlerError{StatusCode: response.StatusServiceUnavailable, Message: "no healthy backend"}.Write(w)
+		return
+	}
+	p.Proxy.fail(w, req, err)
+}
+
+// pick chooses a healthy backend that has not been tried yet, nil when
+// there is none
+func (p *Pool) pick(req *request.Request, tried map[*Backend]bool) *Backend {
+	usable := func(b *Backend) bool {
+		return !tried[b] && b.Healthy()
+	}
+
+	switch p.Strategy {
+	case ConsistentHash:
+		key := hashKey(p.hashSource(req))
+		i, _ := slices.BinarySearchFunc(p.ring, key, func(pt ringPoint, k uint32) int {
+			return cmp.Compare(pt.hash, k)
+		})
+		for j := range p.ring {
+			if b := p.ring[(i+j)%len(p.ring)].backend; usable(b) {
+				return b
+			}
+		}
+		return nil
+
+	case LeastConnections:
+		start := int(p.next.Add(1) - 1)
+		var best *Backend
+		for j := range p.backends {
+			b := p.backends[(start+j)%len(p.backends)]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) {
+				best = b
+			}
+		}
+		return best
+
+	default:
+		start := int(p.next.Add(1) - 1)
+		for j := range p.backends {
+			if b := p.backends[(start+j)%len(p.backends)]; usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// hashSource returns the ConsistentHash key of req
+func (p *Pool) hashSource(req *request.Request) string {
+	if p.HashHeader != "" {
+		if v, ok := req.Headers.Get(p.HashHeader); ok {
+			return v
+		}
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// hashKey hashes s for the ring. FNV alone clusters keys that differ only
+// in their last bytes, so the result goes through murmur3's finalizer.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// markFailed counts a failed request and takes the backend out once it
+// has failed MaxFails times in a row
+func (p *Pool) markFailed(b *Backend, err error) {
+	maxFails := p.MaxFails
+	if maxFails == 0 {
+		maxFails = DefaultMaxFails
+	}
+	failTimeout := p.FailTimeout
+	if failTimeout == 0 {
+		failTimeout = DefaultFailTimeout
+	}
+
+	if int(b.failures.Add(1)) < maxFails {
+		return
+	}
+	if b.Healthy() {
+		p.Proxy.logger().Warn("backend down", "backend", b.URL.String(), "err", err)
+	}
+	b.downUntil.Store(time.Now().Add(failTimeout).UnixNano())
+}
+
+// StartHealthChecks checks every backend right away and then every
+// HealthCheckInterval until Close. It does nothing when HealthCheckPath
+// is empty or the checks are already running.
+func (p *Pool) StartHealthChecks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.HealthCheckPath == "" || p.stop != nil {
+		return
+	}
+	interval := p.HealthCheckInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			p.checkAll()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// Close stops the health checks
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.check(b)
+		}()
+	}
+	wg.Wait()
+}
+
+// check requests HealthCheckPath from b. A failed check keeps the backend
+// out until a check succeeds.
+func (p *Pool) check(b *Backend) {
+	timeout := p.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req := request.NewRequest()
+	req.RequestLine = request.RequestLine{Method: "GET", RequestTarget: p.HealthCheckPath, HttpVersion: "1.1"}
+
+	res, err := p.Proxy.roundTrip(ctx, b.URL, req)
+	if err == nil {
+		// reading the body to the end keeps the connection for reuse
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			err = fmt.Errorf("health check returned %d", res.StatusCode)
+		}
+	}
+
+	logger := p.Proxy.logger()
+	if err != nil {
+		if b.Healthy() {
+			logger.Warn("backend down", "backend", b.URL.String(), "err", err)
+		}
+		b.downUntil.Store(math.MaxInt64)
+		return
+	}
+	if !b.Healthy() {
+		logger.Info("backend up", "backend", b.URL.String())
+	}
+	b.failures.Store(0)
+	b.downUntil.Store(0)
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBackends starts n upstreams that answer with their own index
+func startBackends(t *testing.T, n int) []string {
+	urls := []string{}
+	for i := range n {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strconv.Itoa(i)))
+		}))
+		t.Cleanup(s.Close)
+		urls = append(urls, s.URL)
+	}
+	return urls
+}
+
+// deadTarget returns an address nothing listens on
+func deadTarget(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func newPool(t *testing.T, targets ...string) *Pool {
+	p, err := NewPool(targets...)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func send(t *testing.T, method, url string, header ...string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader("body"))
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	base := startProxy(t, newPool(t, startBackends(t, 3)...).Serve)
+
+	got := ""
+	for range 6 {
+		_, body := send(t, "GET", base+"/")
+		got += body
+	}
+	assert.Equal(t, "012012", got)
+}
+
+func TestLeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := startBackends(t, 1)[0]
+
+	p := newPool(t, slow.URL, fast)
+	p.Strategy = LeastConnections
+	base := startProxy(t, p.Serve)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if res, err := http.Get(base + "/"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	require.Eventually(t, func() bool {
+		return p.Backends()[0].ActiveRequests() == 1
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// the slow backend is busy, so everything else goes to the fast one
+	for range 3 {
+		_, body := send(t, "GET", base+"/")
+		assert.Equal(t, "0", body)
+	}
+	close(release)
+	<-done
+}
+
+func TestConsistentHash(t *testing.T) {
+	p := newPool(t, startBackends(t, 3)...)
+	p.Strategy = ConsistentHash
+	p.HashHeader = "X-User"
+	base := startProxy(t, p.Serve)
+
+	placement := map[string]string{}
+	for i := range 30 {
+		user := "user-" + strconv.Itoa(i)
+		_, placement[user] = send(t, "GET", base+"/", "X-User", user)
+	}
+	assert.Len(t, uniq(placement), 3, "keys should spread over every backend")
+
+	for user, backend := range placement {
+		_, body := send(t, "GET", base+"/", "X-User", user)
+		assert.Equal(t, backend, body, user)
+	}
+
+	// only the keys of a backend that goes down move
+	p.Backends()[1].downUntil.Store(math.MaxInt64)
+	for user, backend := range placement {
+		_, body := send(t, "GET", base+"/", "X-User", user)
+		if backend == "1" {
+			assert.NotEqual(t, "1", body, user)
+		} else {
+			assert.Equal(t, backend, body, user)
+		}
+	}
+}
+
+func uniq(m map[string]string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range m {
+		set[v] = true
+	}
+	return set
+}
+
+func TestRetriesOnlyIdempotentMethods(t *testing.T) {
+	live := startBackends(t, 1)[0]
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{name: "GET Is Retried", method: "GET", status: http.StatusOK},
+		{name: "PUT Is Retried", method: "PUT", status: http.StatusOK},
+		{name: "POST Is Not Retried", method: "POST", status: http.StatusBadGateway},
+		{name: "PATCH Is Not Retried", method: "PATCH", status: http.StatusBadGateway},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// round robin starts with the dead backend
+			p := newPool(t, deadTarget(t), live)
+			p.Retries = 1
+			base := startProxy(t, p.Serve)
+
+			status, _ := send(t, tc.method, base+"/")
+			assert.Equal(t, tc.status, status)
+		})
+	}
+}
+
+func TestPassiveRemoval(t *testing.T) {
+	p := newPool(t, deadTarget(t), startBackends(t, 1)[0])
+	p.Retries = 1
+	p.MaxFails = 2
+	base := startProxy(t, p.Serve)
+
+	for range 4 {
+		status, _ := send(t, "GET", base+"/")
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.False(t, p.Backends()[0].Healthy())
+	assert.True(t, p.Backends()[1].Healthy())
+}
+
+func TestNoHealthyBackend(t *testing.T) {
+	p := newPool(t, deadTarget(t))
+	p.MaxFails = 1
+	base := startProxy(t, p.Serve)
+
+	status, _ := send(t, "GET", base+"/")
+	assert.Equal(t, http.StatusBadGateway, status)
+	status, _ = send(t, "GET", base+"/")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+
+	p := newPool(t, flaky.URL, startBackends(t, 1)[0])
+	p.HealthCheckPath = "/healthz"
+	p.HealthCheckInterval = 10 * time.Millisecond
+	p.StartHealthChecks()
+	base := startProxy(t, p.Serve)
+	backend := p.Backends()[0]
+
+	healthy.Store(false)
+	require.Eventually(t, func() bool { return !backend.Healthy() }, 2*time.Second, 5*time.Millisecond)
+	for range 3 {
+		_, body := send(t, "GET", base+"/")
+		assert.Equal(t, "0", body)
+	}
+
+	healthy.Store(true)
+	require.Eventually(t, backend.Healthy, 2*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/client"
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+const DefaultDialTimeout = 10 * time.Second
+
+// hopHeaders only apply to a single connection and are never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ReverseProxy forwards requests to a single upstream over HTTP/1.1. The
+// upstream response is streamed back as it arrives, trailers included. The
+// request body is not streamed: the server reads it in full before the
+// handler runs, so uploads are bounded by the server's MaxBodyBytes.
+type ReverseProxy struct {
+	// Target is the upstream. Its path, if any, is prefixed to the path of
+	// every forwarded request.
+	Target *url.URL
+	// StripPrefix is removed from the request path before it is joined to
+	// the target path
+	StripPrefix string
+	// PreserveHost forwards the client's Host header instead of the
+	// target's
+	PreserveHost bool
+	// Client sends requests upstream and keeps connections open between
+	// them. Set it to tune timeouts, TLS and pool limits; redirects are
+	// passed on rather than followed and its Jar is not used. When nil a
+	// client shared by all proxies is used.
+	Client *client.Client
+	// ModifyResponse, when set, may change the upstream response before it
+	// is relayed, wrapping its Body for instance. An error answers 502.
+	ModifyResponse func(*response.Response) error
+	Logger         *slog.Logger
+}
+
+// defaultClient serves proxies without a Client of their own
+var defaultClient = &client.Client{DialTimeout: DefaultDialTimeout}
+
+// New returns a proxy for the upstream at target, such as
+// "http://127.0.0.1:9000/api"
+func New(target string) (*ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("proxy: unsupported target %q", target)
+	}
+	return &ReverseProxy{Target: u}, nil
+}
+
+func (p *ReverseProxy) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
+
+// Serve is a server.Handler that forwards req to the target
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	res, err := p.roundTrip(req.Context(), p.Target, req)
+	if err != nil {
+		p.fail(w, req, err)
+		return
+	}
+	defer func() { res.Body.Close() }()
+	if p.ModifyResponse != nil {
+		if err := p.ModifyResponse(res); err != nil {
+			p.fail(w, req, err)
+			return
+		}
+	}
+	p.relay(w, req, res)
+}
+
+// roundTrip sends req to target and returns the upstream response once its
+// head has arrived. The caller must close the body.
+func (p *ReverseProxy) roundTrip(ctx context.Context, target *url.URL, req *request.Request) (*response.Response, error) {
+	c := p.Client
+	if c == nil {
+		c = defaultClient
+	}
+	return c.RoundTrip(p.outgoing(target, req).WithContext(ctx))
+}
+
+// outgoing builds the request sent upstream, with its target in absolute
+// form for the client. The request body has already been read in full by
+// the server, so it goes out with a Content-Length.
+func (p *ReverseProxy) outgoing(target *url.URL, req *request.Request) *request.Request {
+	out := request.NewRequest()
+	out.RequestLine = request.RequestLine{
+		Method:        req.RequestLine.Method,
+		RequestTarget: target.Scheme + "://" + target.Host + p.targetURI(target, req),
+		HttpVersion:   "1.1",
+	}
+	out.Body = req.Body
+
+	h := req.Headers.Clone()
+	removeHopHeaders(h)
+	host, _ := req.Headers.Get("Host")
+	if !p.PreserveHost || host == "" {
+		h.Replace("Host", target.Host)
+	}
+	addForwarded(h, req, host)
+	h.Replace("TE", "trailers")
+	out.Headers = h
+	return out
+}
+
+// targetURI joins the target's path and query with the request's
+func (p *ReverseProxy) targetURI(target *url.URL, req *request.Request) string {
+	path := strings.TrimPrefix(req.Path(), p.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	path = strings.TrimSuffix(target.EscapedPath(), "/") + path
+
+	_, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	switch {
+	case target.RawQuery == "":
+	case query == "":
+		query = target.RawQuery
+	default:
+		query = target.RawQuery + "&" + query
+	}
+	if query != "" {
+		path += "?" + query
+	}
+	return path
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including any the
+// Connection header names
+func removeHopHeaders(h *headers.Headers) {
+	if conn, ok := h.Get("Connection"); ok {
+		for _, name := range strings.Split(conn, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Delete(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Delete(name)
+	}
+}
+
+// addForwarded records the client in the X-Forwarded-* headers and in a
+// Forwarded element (RFC 7239), appending to whatever earlier proxies sent
+func addForwarded(h *headers.Headers, req *request.Request, host string) {
+	ip := req.RemoteAddr
+	if addr, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = addr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if ip != "" {
+		if prior, ok := h.Get("X-Forwarded-For"); ok {
+			h.Replace("X-Forwarded-For", prior+", "+ip)
+		} else {
+			h.Replace("X-Forwarded-For", ip)
+		}
+	}
+	if host != "" {
+		h.Replace("X-Forwarded-Host", host)
+	}
+	h.Replace("X-Forwarded-Proto", proto)
+
+	elem := []string{}
+	if ip != "" {
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = `"[` + ip + `]"`
+		}
+		elem = append(elem, "for="+node)
+	}
+	if host != "" {
+		elem = append(elem, "host="+forwardedValue(host))
+	}
+	elem = append(elem, "proto="+proto)
+	forwarded := strings.Join(elem, ";")
+	if prior, ok := h.Get("Forwarded"); ok {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Replace("Forwarded", forwarded)
+}
+
+// forwardedValue quotes v unless it is a plain token
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\" ;,") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// relay streams the upstream response to the client
+func (p *ReverseProxy) relay(w *response.Writer, req *request.Request, res *response.Response) {
+	h := res.Headers.Clone()
+	removeHopHeaders(h)
+	status := res.StatusCode
+	bodyless := req.RequestLine.Method == "HEAD" || status == 204 || status == 304
+	_, sized := h.Get("Content-Length")
+	chunked := !bodyless && !sized
+	if chunked {
+		h.Replace("Transfer-Encoding", "chunked")
+		if trailer, ok := res.Headers.Get("Trailer"); ok {
+			h.Replace("Trailer", trailer)
+		}
+	}
+
+	if err := w.WriteStatusLine(status); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(*h); err != nil || bodyless {
+		return
+	}
+
+	write := w.WriteBody
+	if chunked {
+		write = w.WriteChunkedBody
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := write(buf[:n]); werr != nil {
+				p.logger().Info("client went away", "target", req.RequestLine.RequestTarget, "err", werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.logger().Warn("upstream body failed", "target", req.RequestLine.RequestTarget, "err", err)
+			// cut the client off so a truncated body is not mistaken for
+			// a complete one
+			w.Abort()
+			return
+		}
+	}
+
+	if chunked {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return
+		}
+		w.WriteHeaders(*res.Trailers)
+	}
+}
+
+// fail answers with 504 when the upstream timed out and 502 otherwise
+func (p *ReverseProxy) fail(w *response.Writer, req *request.Request, err error) {
+	herr := server.HandlerError{StatusCode: response.StatusBadGateway, Message: "bad gateway"}
+	if timedOut(req.Context(), err) {
+		herr = server.HandlerError{StatusCode: response.StatusGatewayTimeout, Message: "gateway timeout"}
+	}
+	p.logger().Warn("upstream request failed", "target", req.RequestLine.RequestTarget, "status", int(herr.StatusCode), "err", err)
+	herr.Write(w)
+}
+
+func timedOut(ctx context.Context, err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/client"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startProxy serves handler on a local port and returns its base URL
+func startProxy(t *testing.T, handler server.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: handler}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + l.Addr().String()
+}
+
+func newProxy(t *testing.T, target string) *ReverseProxy {
+	p, err := New(target)
+	require.NoError(t, err)
+	return p
+}
+
+func TestForwardsRequestAndResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/api/items?v=1&q=go", r.URL.RequestURI())
+		assert.Equal(t, "payload", string(body))
+		assert.Equal(t, "127.0.0.1", r.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", r.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "front.example.com", r.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "for=127.0.0.1;host=front.example.com;proto=http", r.Header.Get("Forwarded"))
+		assert.Empty(t, r.Header.Get("X-Hop"))
+		assert.Empty(t, r.Header.Get("Keep-Alive"))
+		assert.Equal(t, "kept", r.Header.Get("X-End-To-End"))
+
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+
+	// the target's path and query are joined with the request's
+	base := startProxy(t, newProxy(t, upstream.URL+"/api?v=1").Serve)
+
+	req, err := http.NewRequest("POST", base+"/items?q=go", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Host = "front.example.com"
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-End-To-End", "kept")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "yes", res.Header.Get("X-Upstream"))
+	assert.Equal(t, "created", string(body))
+	assert.Equal(t, "abc123", res.Trailer.Get("X-Checksum"))
+}
+
+func TestAppendsToForwardingHeaders(t *testing.T) {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL)
+	p.PreserveHost = true
+	base := startProxy(t, p.Serve)
+
+	req, err := http.NewRequest("GET", base+"/", nil)
+	require.NoError(t, err)
+	req.Host = "front.example.com:8443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("Forwarded", "for=203.0.113.7")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	h := <-got
+	assert.Equal(t, "203.0.113.7, 127.0.0.1", h.Get("X-Forwarded-For"))
+	assert.Equal(t, `for=203.0.113.7, for=127.0.0.1;host="front.example.com:8443";proto=http`, h.Get("Forwarded"))
+}
+
+func TestStreamsResponseBody(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	base := startProxy(t, newProxy(t, upstream.URL).Serve)
+	res, err := http.Get(base + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	// the first line arrives while the upstream is still holding the rest
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+}
+
+func TestModifyResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL)
+	p.ModifyResponse = func(res *response.Response) error {
+		res.Headers.Replace("X-Modified", "yes")
+		return nil
+	}
+	base := startProxy(t, p.Serve)
+	res, err := http.Get(base + "/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "yes", res.Header.Get("X-Modified"))
+	assert.Equal(t, "upstream", string(body))
+
+	p.ModifyResponse = func(res *response.Response) error { return errors.New("rejected") }
+	res, err = http.Get(base + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func TestHeadHasNoBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "42")
+	}))
+	defer upstream.Close()
+
+	base := startProxy(t, newProxy(t, upstream.URL).Serve)
+	res, err := http.Head(base + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(42), res.ContentLength)
+}
+
+func TestReusesUpstreamConnections(t *testing.T) {
+	var mu sync.Mutex
+	addrs := map[string]bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		addrs[r.RemoteAddr] = true
+		mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL)
+	p.Client = &client.Client{}
+	defer p.Client.CloseIdleConnections()
+	base := startProxy(t, p.Serve)
+
+	for _, method := range []string{"GET", "HEAD", "GET"} {
+		req, err := http.NewRequest(method, base+"/", nil)
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, addrs, 1)
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	// an address nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("not http at all\r\n\r\n"))
+		conn.Close()
+	}))
+	defer garbage.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{
+			name:   "Connection Refused",
+			target: refused,
+			status: http.StatusBadGateway,
+		},
+		{
+			name:   "Response Header Timeout",
+			target: slow.URL,
+			status: http.StatusGatewayTimeout,
+		},
+		{
+			name:   "Malformed Response",
+			target: garbage.URL,
+			status: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newProxy(t, tc.target)
+			p.Client = &client.Client{ResponseHeaderTimeout: 100 * time.Millisecond}
+			base := startProxy(t, p.Serve)
+
+			res, err := http.Get(base + "/")
+			require.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tc.status, res.StatusCode)
+		})
+	}
+}
+
+func TestTruncatedUpstreamBodyAbortsClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nonly a little"))
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	base := startProxy(t, newProxy(t, upstream.URL).Serve)
+	res, err := http.Get(base + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestTruncatedUpstreamBodyResetsHTTP2Stream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: newProxy(t, upstream.URL).Serve, EnableHTTP2: true}
+	go s.Serve(l)
+	defer s.Close()
+
+	// with no length to check, only the reset tells the client the body
+	// was cut short
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	res, err := h2c.Get("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+	body, err := io.ReadAll(res.Body)
+	assert.Equal(t, "hello", string(body))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "INTERNAL_ERROR")
+}
+
+func TestNewRejectsBadTargets(t *testing.T) {
+	for _, target := range []string{"ftp://example.com", "/relative", "http://"} {
+		_, err := New(target)
+		assert.Error(t, err, target)
+	}
+}
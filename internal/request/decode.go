@@ -0,0 +1,87 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrorUnsupportedContentEncoding = fmt.Errorf("unsupported content-encoding")
+var ErrorBodyTooLarge = fmt.Errorf("decoded body too large")
+var ErrorMalformedBody = fmt.Errorf("malformed encoded body")
+
+// SupportedContentEncodings lists the codings DecodeBody understands
+var SupportedContentEncodings = []string{"gzip", "deflate"}
+
+// DecodeBody undoes the Content-Encoding of the body in place, so handlers
+// see the bytes the client meant to send. The decoded body may not exceed
+// maxSize bytes, which keeps small zip bombs from growing into huge ones.
+// On success Content-Encoding is removed and Content-Length updated.
+func (r *Request) DecodeBody(maxSize int) error {
+	value, ok := r.Headers.Get("Content-Encoding")
+	if !ok {
+		return nil
+	}
+
+	codings := []string{}
+	for _, coding := range strings.Split(value, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		codings = append(codings, coding)
+	}
+
+	body := r.Body
+	// codings are listed in the order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoded, err := decode(codings[i], body, maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	if _, ok := r.Headers.Get("Content-Length"); ok {
+		r.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func decode(coding string, body []byte, maxSize int) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch coding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// "deflate" is meant to be zlib wrapped, but plenty of clients send raw deflate
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnsupportedContentEncoding, coding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorMalformedBody, err)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorMalformedBody, err)
+	}
+	if len(decoded) > maxSize {
+		return nil, ErrorBodyTooLarge
+	}
+	return decoded, nil
+}
@@ -0,0 +1,516 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+)
+
+var ErrorMalformedForm = fmt.Errorf("malformed form")
+var ErrorFormTooLarge = fmt.Errorf("form too large")
+
+const (
+	// DefaultMaxMemory is how many bytes of uploaded files a form keeps in
+	// memory before the rest spill to temporary files
+	DefaultMaxMemory = 10 << 20
+	// DefaultMaxFieldBytes limits the total size of the non-file fields
+	DefaultMaxFieldBytes = 10 << 20
+	// DefaultMaxParts limits the number of parts in a multipart body
+	DefaultMaxParts = 1000
+)
+
+// maxPartHeaderBytes limits the header block of a single part
+const maxPartHeaderBytes = 16 << 10
+
+type FormOptions struct {
+	// MaxMemory defaults to DefaultMaxMemory
+	MaxMemory int64
+	// MaxFileSize limits each uploaded file. Zero means no limit beyond
+	// the size of the body.
+	MaxFileSize int64
+	// MaxFieldBytes defaults to DefaultMaxFieldBytes
+	MaxFieldBytes int64
+	// MaxParts defaults to DefaultMaxParts
+	MaxParts int
+	// TempDir is where spilled files go, os.TempDir() when empty
+	TempDir string
+}
+
+func (o FormOptions) withDefaults() FormOptions {
+	if o.MaxMemory <= 0 {
+		o.MaxMemory = DefaultMaxMemory
+	}
+	if o.MaxFieldBytes <= 0 {
+		o.MaxFieldBytes = DefaultMaxFieldBytes
+	}
+	if o.MaxParts <= 0 {
+		o.MaxParts = DefaultMaxParts
+	}
+	return o
+}
+
+// Form holds the fields of a submitted form together with the query
+// parameters, body fields first, and the uploaded files. A form from
+// ParseMultipart needs RemoveAll once done with it to delete any temporary
+// files; the server takes care of forms from ParseForm.
+type Form struct {
+	Values url.Values
+	Files  map[string][]*FileHeader
+}
+
+func newForm() *Form {
+	return &Form{Values: url.Values{}, Files: map[string][]*FileHeader{}}
+}
+
+// Get returns the first value of key, or "" when there is none
+func (f *Form) Get(key string) string {
+	return f.Values.Get(key)
+}
+
+// File returns the first file uploaded as key and whether there was one
+func (f *Form) File(key string) (*FileHeader, bool) {
+	if files := f.Files[key]; len(files) > 0 {
+		return files[0], true
+	}
+	return nil, false
+}
+
+// RemoveAll deletes the temporary files the form spilled to disk
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.Files {
+		for _, fh := range files {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// File is an uploaded file opened for reading
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// FileHeader describes a file part of a multipart form
+type FileHeader struct {
+	// Filename is the name the client gave, stripped of any directories
+	Filename string
+	// Headers are the part's own headers, such as Content-Type
+	Headers *headers.Headers
+	Size    int64
+
+	content []byte
+	tmpfile string
+}
+
+// Open returns the file's content, from memory or from its temporary file
+func (fh *FileHeader) Open() (File, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return nopCloser{bytes.NewReader(fh.content)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Query returns the parameters in the query string of the request target
+func (r *Request) Query() url.Values {
+	_, query, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	values, _ := url.ParseQuery(query)
+	return values
+}
+
+type parsedForm struct {
+	form *Form
+}
+
+// ParseForm parses the query string and, for POST, PUT and PATCH requests,
+// a body sent as application/x-www-form-urlencoded or multipart/form-data.
+// Other bodies are left alone. The form is parsed once; later calls return
+// it again whatever opts they pass.
+//
+// The body is already in memory, so files past opts.MaxMemory are copied
+// from it to temporary files. The server removes them once the handler
+// returns.
+func (r *Request) ParseForm(opts FormOptions) (*Form, error) {
+	if r.form == nil {
+		r.form = &parsedForm{}
+	}
+	if r.form.form != nil {
+		return r.form.form, nil
+	}
+	opts = opts.withDefaults()
+
+	form := newForm()
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		contentType, _ := r.Headers.Get("Content-Type")
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if contentType != "" && err != nil {
+			return nil, fmt.Errorf("%w: content-type: %v", ErrorMalformedForm, err)
+		}
+		switch mediaType {
+		case "application/x-www-form-urlencoded":
+			form, err = parseURLEncoded(r.Body, opts)
+		case "multipart/form-data":
+			form, err = ParseMultipart(bytes.NewReader(r.Body), params["boundary"], opts)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, values := range r.Query() {
+		form.Values[key] = append(form.Values[key], values...)
+	}
+	r.form.form = form
+	return form, nil
+}
+
+// RemoveForm deletes the temporary files of the form ParseForm returned,
+// if any. The server calls it once the handler has returned.
+func (r *Request) RemoveForm() error {
+	if r.form == nil || r.form.form == nil {
+		return nil
+	}
+	return r.form.form.RemoveAll()
+}
+
+// FormValue returns the first value of key in the form parsed with default
+// options, "" when there is none or the form cannot be parsed
+func (r *Request) FormValue(key string) string {
+	form, err := r.ParseForm(FormOptions{})
+	if err != nil {
+		return ""
+	}
+	return form.Get(key)
+}
+
+func parseURLEncoded(body []byte, opts FormOptions) (*Form, error) {
+	if int64(len(body)) > opts.MaxFieldBytes {
+		return nil, ErrorFormTooLarge
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorMalformedForm, err)
+	}
+	form := newForm()
+	form.Values = values
+	return form, nil
+}
+
+// ParseMultipart reads a multipart/form-data body from r part by part.
+// Files are streamed into memory until opts.MaxMemory is used up and into
+// temporary files after that, which the caller removes with RemoveAll. On
+// error any temporary files are removed.
+func ParseMultipart(r io.Reader, boundary string, opts FormOptions) (*Form, error) {
+	if boundary == "" || len(boundary) > 70 {
+		return nil, fmt.Errorf("%w: bad boundary %q", ErrorMalformedForm, boundary)
+	}
+	opts = opts.withDefaults()
+	form := newForm()
+	err := readMultipart(r, boundary, opts, form)
+	if err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+	return form, nil
+}
+
+func readMultipart(r io.Reader, boundary string, opts FormOptions, form *Form) error {
+	// a leading CRLF lets the first delimiter be found like the others
+	mr := &multipartReader{
+		br:    bufio.NewReaderSize(io.MultiReader(strings.NewReader("\r\n"), r), 64<<10),
+		delim: []byte("\r\n--" + boundary),
+	}
+	memLeft := opts.MaxMemory
+	fieldLeft := opts.MaxFieldBytes
+
+	// the preamble before the first delimiter is ignored
+	if _, err := io.Copy(io.Discard, mr.part()); err != nil {
+		return err
+	}
+	for parts := 0; ; parts++ {
+		last, err := mr.nextPart()
+		if err != nil || last {
+			return err
+		}
+		if parts == opts.MaxParts {
+			return fmt.Errorf("%w: more than %d parts", ErrorFormTooLarge, opts.MaxParts)
+		}
+
+		h, err := mr.partHeaders()
+		if err != nil {
+			return err
+		}
+		disposition, _ := h.Get("Content-Disposition")
+		kind, params, err := mime.ParseMediaType(disposition)
+		if err != nil || kind != "form-data" {
+			return fmt.Errorf("%w: content-disposition %q", ErrorMalformedForm, disposition)
+		}
+		name := params["name"]
+		part := mr.part()
+		if name == "" {
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		filename, isFile := params["filename"]
+		if !isFile || filename == "" {
+			value, err := io.ReadAll(io.LimitReader(part, fieldLeft+1))
+			if err != nil {
+				return err
+			}
+			fieldLeft -= int64(len(value))
+			if fieldLeft < 0 {
+				return fmt.Errorf("%w: fields over %d bytes", ErrorFormTooLarge, opts.MaxFieldBytes)
+			}
+			form.Values.Add(name, string(value))
+			continue
+		}
+
+		fh := &FileHeader{Filename: baseName(filename), Headers: h}
+		// the file is added first so that RemoveAll finds it on error
+		form.Files[name] = append(form.Files[name], fh)
+		if err := fh.store(part, &memLeft, opts); err != nil {
+			return err
+		}
+	}
+}
+
+// store streams a file part into memory while memLeft allows and into a
+// temporary file beyond that
+func (fh *FileHeader) store(part io.Reader, memLeft *int64, opts FormOptions) error {
+	if opts.MaxFileSize > 0 {
+		part = &limitedPart{r: part, left: opts.MaxFileSize}
+	}
+
+	buf := bytes.Buffer{}
+	n, err := io.CopyN(&buf, part, *memLeft+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= *memLeft {
+		*memLeft -= n
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return nil
+	}
+
+	f, err := os.CreateTemp(opts.TempDir, "form-*")
+	if err != nil {
+		return err
+	}
+	fh.tmpfile = f.Name()
+	size, err := io.Copy(f, io.MultiReader(&buf, part))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	fh.Size = size
+	return err
+}
+
+// limitedPart fails a file that runs past its limit instead of cutting it
+type limitedPart struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedPart) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, fmt.Errorf("%w: file over the size limit", ErrorFormTooLarge)
+	}
+	return n, err
+}
+
+// baseName drops control characters and any directories a client left in
+// a filename, with either kind of slash. Names that only point at a
+// directory, such as "..", come back empty.
+func baseName(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	name := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// multipartReader splits a body on its boundary delimiters (RFC 2046
+// section 5.1.1). It stands on a delimiter between parts and on the
+// content of a part while it is read.
+type multipartReader struct {
+	br    *bufio.Reader
+	delim []byte
+}
+
+// nextPart consumes a delimiter and the rest of its line, and reports
+// whether it was the closing one
+func (mr *multipartReader) nextPart() (bool, error) {
+	if _, err := mr.br.Discard(len(mr.delim)); err != nil {
+		return false, unexpected(err)
+	}
+	line, err := mr.br.ReadSlice('\n')
+	if err != nil {
+		if bytes.HasPrefix(line, []byte("--")) && err == io.EOF {
+			return true, nil
+		}
+		return false, unexpected(err)
+	}
+	if bytes.HasPrefix(line, []byte("--")) {
+		return true, nil
+	}
+	// only transport padding may follow a delimiter
+	if len(bytes.TrimRight(line, " \t\r\n")) != 0 {
+		return false, fmt.Errorf("%w: text after boundary", ErrorMalformedForm)
+	}
+	return false, nil
+}
+
+// partHeaders reads the header block that starts a part
+func (mr *multipartReader) partHeaders() (*headers.Headers, error) {
+	block := []byte{}
+	for {
+		line, err := mr.br.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				err = ErrorFormTooLarge
+			}
+			return nil, unexpected(err)
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		block = append(block, line...)
+		block = append(block, "\r\n"...)
+		if len(block) > maxPartHeaderBytes {
+			return nil, fmt.Errorf("%w: part header too large", ErrorFormTooLarge)
+		}
+		if len(line) == 0 {
+			break
+		}
+	}
+	h := headers.NewHeaders()
+	if _, _, err := h.Parse(block); err != nil {
+		return nil, fmt.Errorf("%w: part header: %v", ErrorMalformedForm, err)
+	}
+	return h, nil
+}
+
+// part returns a reader for the content up to the next delimiter
+func (mr *multipartReader) part() io.Reader {
+	return &partReader{mr: mr}
+}
+
+type partReader struct {
+	mr *multipartReader
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	br, delim := p.mr.br, p.mr.delim
+	// atEOF is set once nothing more will arrive
+	atEOF := false
+	for {
+		peek, _ := br.Peek(br.Buffered())
+
+		// content runs up to the first real delimiter, or up to a tail that
+		// could still turn out to be one
+		end := max(len(peek)-len(delim)+1, 0)
+		if atEOF {
+			end = len(peek)
+		}
+		for from := 0; from < len(peek); {
+			i := bytes.Index(peek[from:], delim)
+			if i < 0 {
+				break
+			}
+			i += from
+			real, decided := isDelimiter(peek[i+len(delim):])
+			if real || !decided {
+				end = i
+				if i == 0 && (real || atEOF) {
+					return 0, io.EOF
+				}
+				break
+			}
+			from = i + 1
+		}
+
+		if end > 0 {
+			n := copy(b, peek[:end])
+			br.Discard(n)
+			return n, nil
+		}
+		if atEOF {
+			return 0, unexpected(io.EOF)
+		}
+		if _, err := br.Peek(len(peek) + 1); err == io.EOF {
+			atEOF = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// isDelimiter looks at what follows a match of the delimiter: "--" or
+// padding and a line ending make it a real one, anything else is content
+// that happens to look like it. decided is false when rest is too short
+// to tell.
+func isDelimiter(rest []byte) (real, decided bool) {
+	if len(rest) >= 2 && rest[0] == '-' && rest[1] == '-' {
+		return true, true
+	}
+	if len(rest) == 1 && rest[0] == '-' {
+		return false, false
+	}
+	rest = bytes.TrimLeft(rest, " \t")
+	switch {
+	case len(rest) == 0:
+		return false, false
+	case rest[0] == '\n':
+		return true, true
+	case rest[0] == '\r':
+		if len(rest) == 1 {
+			return false, false
+		}
+		return rest[1] == '\n', true
+	}
+	return false, true
+}
+
+// unexpected turns the end of the body inside a form into an error of its
+// own, since a form always ends with a closing delimiter
+func unexpected(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("%w: %v", ErrorMalformedForm, io.ErrUnexpectedEOF)
+	}
+	return err
+}
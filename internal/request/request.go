@@ -2,11 +2,16 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
-	"log/slog"
 	"strconv"
+	"strings"
 
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
 	"github.com/AmiyoKm/httpfromtcp/internal/headers"
 )
 
@@ -23,6 +28,14 @@ const (
 var ErrorMalformedRequestLine = fmt.Errorf("malformed request-line")
 var ErrorUnsupportedHttpVersion = fmt.Errorf("unsupported http version")
 var ErrorRequestInErrorState = fmt.Errorf("request in error state")
+var ErrorRequestHeaderTooLarge = fmt.Errorf("request header too large")
+var ErrorRequestBodyTooLarge = fmt.Errorf("request body too large")
+var ErrorUnsupportedTransferEncoding = fmt.Errorf("unsupported transfer-encoding")
+var ErrorMalformedContentLength = fmt.Errorf("malformed content-length")
+
+// DefaultMaxHeaderBytes is the default limit on the size of the request line
+// and headers together
+const DefaultMaxHeaderBytes = 1 << 20
 
 var SEPERATOR = []byte("\r\n")
 
@@ -30,7 +43,19 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     *headers.Headers
 	Body        []byte
-	state       parserState
+	// TLS describes the connection the request arrived on, nil for plain
+	// text connections
+	TLS *tls.ConnectionState
+	// RemoteAddr is the network address of the client, set by the server
+	RemoteAddr string
+	state      parserState
+	pathValues map[string]string
+	ctx        context.Context
+	// form is shared with the copies WithContext makes, so the server can
+	// clean up a form parsed by any of them
+	form *parsedForm
+	// contentLength is the validated Content-Length, zero when absent
+	contentLength int
 }
 
 func NewRequest() *Request {
@@ -38,19 +63,126 @@ func NewRequest() *Request {
 		state:   StateInit,
 		Headers: headers.NewHeaders(),
 		Body:    []byte{},
+		form:    &parsedForm{},
+	}
+}
+
+// Context returns the request's context, context.Background() when none
+// was set. The server cancels it when the client goes away, the server
+// shuts down or the write timeout passes.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// Path returns the request target without its query string. For an
+// absolute-form target the scheme and authority are dropped too.
+func (r *Request) Path() string {
+	target := r.RequestLine.RequestTarget
+	if !strings.HasPrefix(target, "/") && isAbsoluteForm(target) {
+		_, rest, _ := strings.Cut(target, "://")
+		i := strings.IndexAny(rest, "/?")
+		if i == -1 {
+			return "/"
+		}
+		target = rest[i:]
+	}
+	path, _, _ := strings.Cut(target, "?")
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// PathValue returns the value captured for a named wildcard by the router,
+// or "" when there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue records a value captured from the path for PathValue
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+// Cookies returns the cookies the Cookie header carries, in the order sent
+func (r *Request) Cookies() []*cookie.Cookie {
+	cookies := []*cookie.Cookie{}
+	for _, line := range r.Headers.Values("Cookie") {
+		cookies = append(cookies, cookie.ParseCookie(line)...)
+	}
+	return cookies
+}
+
+// Cookie returns the first cookie named name and whether there was one
+func (r *Request) Cookie(name string) (*cookie.Cookie, bool) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// ClientCertificate returns the client certificate verified during the TLS
+// handshake, or nil when the client did not present one that was verified
+func (r *Request) ClientCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
 	}
+	return r.TLS.VerifiedChains[0][0]
 }
 
-func getInt(headers *headers.Headers, key string, defaultValue int) int {
-	valStr, ok := headers.Get(key)
+// ClientSubject returns the subject of the verified client certificate and
+// whether there was one
+func (r *Request) ClientSubject() (pkix.Name, bool) {
+	cert := r.ClientCertificate()
+	if cert == nil {
+		return pkix.Name{}, false
+	}
+	return cert.Subject, true
+}
+
+// bodyLength returns the length of the body the headers announce. Bodies
+// framed by Transfer-Encoding are not supported, and a Content-Length must
+// be a plain non-negative integer repeated identically on every line, so
+// that no two readers of the connection can disagree on where the body ends.
+func bodyLength(headers *headers.Headers) (int, error) {
+	if _, ok := headers.Get("transfer-encoding"); ok {
+		return 0, ErrorUnsupportedTransferEncoding
+	}
+	valStr, ok := headers.Get("content-length")
 	if !ok {
-		return defaultValue
+		return 0, nil
 	}
-	value, err := strconv.Atoi(valStr)
-	if err != nil {
-		return defaultValue
+	length := -1
+	for _, v := range strings.Split(valStr, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.Trim(v, "0123456789") != "" {
+			return 0, ErrorMalformedContentLength
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || (length != -1 && n != length) {
+			return 0, ErrorMalformedContentLength
+		}
+		length = n
 	}
-	return value
+	return length, nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -58,7 +190,6 @@ func (r *Request) parse(data []byte) (int, error) {
 outer:
 	for {
 		currentData := data[read:]
-		slog.Info("PARSING#DATA", "CURR", string(data), "length", len(data))
 		if len(currentData) == 0 {
 			break outer
 		}
@@ -96,25 +227,24 @@ outer:
 			read += n
 
 			if done {
+				length, err := bodyLength(r.Headers)
+				if err != nil {
+					r.state = StateError
+					return 0, err
+				}
+				r.contentLength = length
 				r.state = StateBody
-				length := getInt(r.Headers, "content-length", 0)
 				if length == 0 {
 					r.state = StateDone
 				}
 			}
 
 		case StateBody:
-			length := getInt(r.Headers, "content-length", -1)
-
-			if length == 0 {
-				panic("chunked not implemented")
-			}
-
-			remaining := min(length-len(r.Body), len(currentData))
+			remaining := min(r.contentLength-len(r.Body), len(currentData))
 			r.Body = append(r.Body, currentData[:remaining]...)
 			read += remaining
 
-			if len(r.Body) == length {
+			if len(r.Body) == r.contentLength {
 				r.state = StateDone
 			}
 
@@ -125,6 +255,11 @@ outer:
 	return read, nil
 }
 
+// inHead reports whether the request line or headers are still being parsed
+func (r *Request) inHead() bool {
+	return r.state == StateInit || r.state == StateHeaders
+}
+
 func (r *Request) done() bool {
 	return r.state == StateDone
 }
@@ -163,7 +298,7 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	}
 
 	target := string(parts[1])
-	if !isValidTarget(target) {
+	if !isValidTarget(method, target) {
 		return nil, 0, ErrorMalformedRequestLine
 	}
 
@@ -177,24 +312,124 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+// Reader parses consecutive requests from a single connection. Bytes read
+// past the end of one request are kept for the next, which is what makes
+// keep-alive and pipelining work.
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufLen int
+
+	// OnHeaders, when set, is called as soon as the header block of a
+	// request has been parsed, before its body is read.
+	OnHeaders func(*Request)
+	// MaxHeaderBytes limits the request line and headers together.
+	// DefaultMaxHeaderBytes is used when it is zero.
+	MaxHeaderBytes int
+	// MaxBodyBytes limits the Content-Length a request may declare. Zero
+	// means no limit.
+	MaxBodyBytes int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, 4096),
+	}
+}
+
+func (rd *Reader) maxHeaderBytes() int {
+	if rd.MaxHeaderBytes > 0 {
+		return rd.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+// Wait blocks until at least one byte of the next request is available
+func (rd *Reader) Wait() error {
+	for rd.bufLen == 0 {
+		n, err := rd.reader.Read(rd.buf)
+		rd.bufLen += n
+		if err != nil && rd.bufLen == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRequest parses the next request from the connection
+func (rd *Reader) ReadRequest() (*Request, error) {
 	request := NewRequest()
-	buf := make([]byte, 4096)
-	bufLen := 0
+	notified := false
+	headerBytes := 0
+
+	for {
+		if rd.bufLen > 0 {
+			inHead := request.inHead()
+			readN, err := request.parse(rd.buf[:rd.bufLen])
+			if err != nil {
+				return nil, err
+			}
+			if inHead {
+				headerBytes += readN
+			}
+			copy(rd.buf, rd.buf[readN:rd.bufLen])
+			rd.bufLen -= readN
+		}
+
+		if headerBytes > rd.maxHeaderBytes() || (request.inHead() && headerBytes+rd.bufLen > rd.maxHeaderBytes()) {
+			return nil, ErrorRequestHeaderTooLarge
+		}
+		if !request.inHead() && !notified {
+			notified = true
+			if rd.MaxBodyBytes > 0 && request.contentLength > rd.MaxBodyBytes {
+				return nil, ErrorRequestBodyTooLarge
+			}
+			if rd.OnHeaders != nil {
+				rd.OnHeaders(request)
+			}
+		}
+		if request.done() || request.error() {
+			return request, nil
+		}
 
-	for !request.done() && !request.error() {
-		n, err := reader.Read(buf[bufLen:])
+		if rd.bufLen == len(rd.buf) {
+			// a single line of the head does not fit, make room for it
+			grown := make([]byte, 2*len(rd.buf))
+			copy(grown, rd.buf[:rd.bufLen])
+			rd.buf = grown
+		}
+		n, err := rd.reader.Read(rd.buf[rd.bufLen:])
 		if err != nil {
 			return nil, err
 		}
+		rd.bufLen += n
+	}
+}
 
-		bufLen += n
-		readN, err := request.parse(buf[:bufLen])
-		slog.Info("REQUST_FROM_READER", "readN", readN, "buf", string(buf[:bufLen]))
+// Peek reads until at least n bytes are buffered or the connection fails
+// and returns the buffered bytes without consuming them
+func (rd *Reader) Peek(n int) ([]byte, error) {
+	for rd.bufLen < n {
+		if rd.bufLen == len(rd.buf) {
+			grown := make([]byte, max(n, 2*len(rd.buf)))
+			copy(grown, rd.buf[:rd.bufLen])
+			rd.buf = grown
+		}
+		m, err := rd.reader.Read(rd.buf[rd.bufLen:])
+		rd.bufLen += m
 		if err != nil {
-			return nil, err
+			return rd.buf[:rd.bufLen], err
 		}
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
 	}
-	return request, nil
+	return rd.buf[:rd.bufLen], nil
+}
+
+// Buffered returns a copy of the bytes read from the connection but not yet
+// consumed, for handing the connection over to another protocol
+func (rd *Reader) Buffered() []byte {
+	return append([]byte(nil), rd.buf[:rd.bufLen]...)
 }
@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
 	"io"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -83,6 +89,35 @@ func TestRequestLineParse(t *testing.T) {
 			chunkSize:      1,
 			expectError:    true,
 		},
+		{
+			name:            "Absolute-form target",
+			input:           "GET http://example.com/coffee?roast=dark HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectedMethod:  "GET",
+			expectedTarget:  "http://example.com/coffee?roast=dark",
+			expectedVersion: "1.1",
+		},
+		{
+			name:            "CONNECT with authority-form target",
+			input:           "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			expectedMethod:  "CONNECT",
+			expectedTarget:  "example.com:443",
+			expectedVersion: "1.1",
+		},
+		{
+			name:        "CONNECT with origin-form target",
+			input:       "CONNECT / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectError: true,
+		},
+		{
+			name:        "Authority-form target without CONNECT",
+			input:       "GET example.com:443 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectError: true,
+		},
+		{
+			name:        "Absolute-form target with unsupported scheme",
+			input:       "GET ftp://example.com/file HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectError: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -114,6 +149,47 @@ func TestRequestLineParse(t *testing.T) {
 	}
 }
 
+func TestPath(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+		path   string
+	}{
+		{name: "Origin-form", target: "/coffee?roast=dark", path: "/coffee"},
+		{name: "Absolute-form", target: "http://example.com/coffee?roast=dark", path: "/coffee"},
+		{name: "Absolute-form without path", target: "https://example.com", path: "/"},
+		{name: "Absolute-form with only a query", target: "http://example.com?roast=dark", path: "/"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRequest()
+			r.RequestLine.RequestTarget = tc.target
+			assert.Equal(t, tc.path, r.Path())
+		})
+	}
+}
+
+func TestCookies(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: localhost:42069\r\nCookie: session=abc123; theme=\"dark\"; bad name=1; lang=en\r\n\r\n"
+	r, err := RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 4})
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, c := range r.Cookies() {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	assert.Equal(t, []string{"session=abc123", "theme=dark", "lang=en"}, names)
+
+	c, ok := r.Cookie("theme")
+	require.True(t, ok)
+	assert.Equal(t, "dark", c.Value)
+	_, ok = r.Cookie("missing")
+	assert.False(t, ok)
+
+	assert.Empty(t, NewRequest().Cookies())
+}
+
 func TestParseHeaders(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -221,3 +297,367 @@ func TestParseBody(t *testing.T) {
 		})
 	}
 }
+
+func TestParseBodyFraming(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      string
+		expectedErr  error
+		expectedBody string
+	}{
+		{
+			name:        "chunked transfer-encoding",
+			headers:     "Transfer-Encoding: chunked\r\n",
+			expectedErr: ErrorUnsupportedTransferEncoding,
+		},
+		{
+			name:        "transfer-encoding with content-length",
+			headers:     "Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+			expectedErr: ErrorUnsupportedTransferEncoding,
+		},
+		{
+			name:        "negative content-length",
+			headers:     "Content-Length: -5\r\n",
+			expectedErr: ErrorMalformedContentLength,
+		},
+		{
+			name:        "signed content-length",
+			headers:     "Content-Length: +5\r\n",
+			expectedErr: ErrorMalformedContentLength,
+		},
+		{
+			name:        "non-numeric content-length",
+			headers:     "Content-Length: five\r\n",
+			expectedErr: ErrorMalformedContentLength,
+		},
+		{
+			name:        "conflicting content-length lines",
+			headers:     "Content-Length: 5\r\nContent-Length: 6\r\n",
+			expectedErr: ErrorMalformedContentLength,
+		},
+		{
+			name:         "repeated identical content-length",
+			headers:      "Content-Length: 5\r\nContent-Length: 5\r\n",
+			expectedBody: "hello",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\n" + tc.headers + "\r\nhello world"
+			r, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 3})
+			if tc.expectedErr != nil {
+				require.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, string(r.Body))
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	deflated := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name         string
+		encoding     string
+		body         []byte
+		maxSize      int
+		expectError  error
+		expectedBody string
+	}{
+		{
+			name:         "gzip",
+			encoding:     "gzip",
+			body:         gzipped("telemetry payload"),
+			maxSize:      1024,
+			expectedBody: "telemetry payload",
+		},
+		{
+			name:         "stacked gzip then deflate",
+			encoding:     "gzip, deflate",
+			body:         deflated(gzipped("twice encoded")),
+			maxSize:      1024,
+			expectedBody: "twice encoded",
+		},
+		{
+			name:         "identity",
+			encoding:     "identity",
+			body:         []byte("plain"),
+			maxSize:      1024,
+			expectedBody: "plain",
+		},
+		{
+			name:        "decoded body over the limit",
+			encoding:    "gzip",
+			body:        gzipped(strings.Repeat("a", 4096)),
+			maxSize:     1024,
+			expectError: ErrorBodyTooLarge,
+		},
+		{
+			name:        "unsupported encoding",
+			encoding:    "br",
+			body:        []byte("whatever"),
+			maxSize:     1024,
+			expectError: ErrorUnsupportedContentEncoding,
+		},
+		{
+			name:        "corrupt gzip",
+			encoding:    "gzip",
+			body:        []byte("not gzip at all"),
+			maxSize:     1024,
+			expectError: ErrorMalformedBody,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := fmt.Sprintf("POST /ingest HTTP/1.1\r\nHost: localhost:42069\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s",
+				tc.encoding, len(tc.body), tc.body)
+			r, err := RequestFromReader(strings.NewReader(raw))
+			require.NoError(t, err)
+
+			err = r.DecodeBody(tc.maxSize)
+			if tc.expectError != nil {
+				require.ErrorIs(t, err, tc.expectError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedBody, string(r.Body))
+			_, ok := r.Headers.Get("content-encoding")
+			assert.False(t, ok)
+			val, _ := r.Headers.Get("content-length")
+			assert.Equal(t, fmt.Sprint(len(tc.expectedBody)), val)
+		})
+	}
+}
+
+func TestParseFormURLEncoded(t *testing.T) {
+	testCases := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		opts        FormOptions
+		expected    url.Values
+		expectError error
+	}{
+		{
+			name:        "body fields come before the query",
+			method:      "POST",
+			target:      "/search?q=tea&page=2",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "q=coffee&roast=dark+roast&note=caf%C3%A9",
+			expected:    url.Values{"q": {"coffee", "tea"}, "page": {"2"}, "roast": {"dark roast"}, "note": {"café"}},
+		},
+		{
+			name:     "GET bodies are not forms",
+			method:   "GET",
+			target:   "/search?q=tea",
+			body:     "q=coffee",
+			expected: url.Values{"q": {"tea"}},
+		},
+		{
+			name:        "other content types are left alone",
+			method:      "POST",
+			target:      "/upload",
+			contentType: "application/json",
+			body:        `{"q":"coffee"}`,
+			expected:    url.Values{},
+		},
+		{
+			name:        "bad escape",
+			method:      "POST",
+			target:      "/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "q=%zz",
+			expectError: ErrorMalformedForm,
+		},
+		{
+			name:        "too large",
+			method:      "POST",
+			target:      "/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "q=" + strings.Repeat("a", 100),
+			opts:        FormOptions{MaxFieldBytes: 64},
+			expectError: ErrorFormTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n", tc.method, tc.target, len(tc.body))
+			if tc.contentType != "" {
+				raw += "Content-Type: " + tc.contentType + "\r\n"
+			}
+			r, err := RequestFromReader(strings.NewReader(raw + "\r\n" + tc.body))
+			require.NoError(t, err)
+
+			form, err := r.ParseForm(tc.opts)
+			if tc.expectError != nil {
+				require.ErrorIs(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, form.Values)
+		})
+	}
+}
+
+const multipartBody = "preamble to ignore\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"Holiday\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"C:\\\\Users\\\\ada\\\\beach.jpg\"\r\n" +
+	"Content-Type: image/jpeg\r\n" +
+	"\r\n" +
+	"\xff\xd8jpeg bytes with a fake\r\n--XyZ boundary inside\r\n\xff\xd9\r\n" +
+	"--XyZ  \r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"../../notes.txt\"\r\n" +
+	"\r\n" +
+	"second file\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"empty\"; filename=\"\"\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"--XyZ--\r\n" +
+	"epilogue to ignore"
+
+func TestParseMultipart(t *testing.T) {
+	raw := fmt.Sprintf("POST /albums?album=summer HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=\"XyZ\"\r\nContent-Length: %d\r\n\r\n%s", len(multipartBody), multipartBody)
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	form, err := r.ParseForm(FormOptions{})
+	require.NoError(t, err)
+	defer form.RemoveAll()
+
+	assert.Equal(t, url.Values{"title": {"Holiday"}, "empty": {""}, "album": {"summer"}}, form.Values)
+	assert.Equal(t, "Holiday", r.FormValue("title"))
+
+	require.Len(t, form.Files["photo"], 2)
+	photo, ok := form.File("photo")
+	require.True(t, ok)
+	assert.Equal(t, "beach.jpg", photo.Filename)
+	contentType, _ := photo.Headers.Get("Content-Type")
+	assert.Equal(t, "image/jpeg", contentType)
+	want := "\xff\xd8jpeg bytes with a fake\r\n--XyZ boundary inside\r\n\xff\xd9"
+	assert.Equal(t, int64(len(want)), photo.Size)
+	f, err := photo.Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(content))
+
+	assert.Equal(t, "notes.txt", form.Files["photo"][1].Filename)
+}
+
+func TestBaseName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../notes.txt", "notes.txt"},
+		{`C:\Users\ada\beach.jpg`, "beach.jpg"},
+		{"..", ""},
+		{"../..", ""},
+		{"a/..", ""},
+		{`..\..`, ""},
+		{".", ""},
+		{"/", ""},
+		{"..\x00", ""},
+		{"evil\x00.jpg", "evil.jpg"},
+		{"line\r\nbreak\x1b[0m.txt", "linebreak[0m.txt"},
+		{"tab\tname\x7f.txt", "tabname.txt"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, baseName(tc.filename), "%q", tc.filename)
+	}
+}
+
+func TestParseMultipartSpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	// the stream arrives a few bytes at a time, so delimiters straddle reads
+	form, err := ParseMultipart(&chunkReader{data: multipartBody, numBytesPerRead: 3}, "XyZ", FormOptions{MaxMemory: 16, TempDir: dir})
+	require.NoError(t, err)
+
+	files := form.Files["photo"]
+	require.Len(t, files, 2)
+	// the first file does not fit in memory, the second still does
+	assert.NotEmpty(t, files[0].tmpfile)
+	assert.Empty(t, files[1].tmpfile)
+	for i, want := range []string{"\xff\xd8jpeg bytes with a fake\r\n--XyZ boundary inside\r\n\xff\xd9", "second file"} {
+		f, err := files[i].Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+		assert.Equal(t, want, string(content))
+	}
+
+	spilled, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, spilled, 1)
+	require.NoError(t, form.RemoveAll())
+	spilled, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, spilled)
+}
+
+func TestParseMultipartErrors(t *testing.T) {
+	part := func(name, filename, content string) string {
+		disposition := `form-data; name="` + name + `"`
+		if filename != "" {
+			disposition += `; filename="` + filename + `"`
+		}
+		return "--b\r\nContent-Disposition: " + disposition + "\r\n\r\n" + content + "\r\n"
+	}
+
+	testCases := []struct {
+		name        string
+		boundary    string
+		body        string
+		opts        FormOptions
+		expectError error
+	}{
+		{name: "missing boundary", boundary: "", body: part("a", "", "1") + "--b--", expectError: ErrorMalformedForm},
+		{name: "no closing delimiter", boundary: "b", body: part("a", "", "1"), expectError: ErrorMalformedForm},
+		{name: "no delimiter at all", boundary: "b", body: "just text", expectError: ErrorMalformedForm},
+		{name: "boundary followed by text is no delimiter", boundary: "b", body: "--b junk\r\n\r\n--b-", expectError: ErrorMalformedForm},
+		{name: "not form-data", boundary: "b", body: "--b\r\nContent-Disposition: attachment\r\n\r\nx\r\n--b--", expectError: ErrorMalformedForm},
+		{name: "file over the limit", boundary: "b", body: part("f", "big.bin", strings.Repeat("x", 65)) + "--b--", opts: FormOptions{MaxFileSize: 64}, expectError: ErrorFormTooLarge},
+		{name: "spilled file over the limit", boundary: "b", body: part("f", "big.bin", strings.Repeat("x", 65)) + "--b--", opts: FormOptions{MaxFileSize: 64, MaxMemory: 8}, expectError: ErrorFormTooLarge},
+		{name: "fields over the limit", boundary: "b", body: part("a", "", strings.Repeat("x", 40)) + part("b", "", strings.Repeat("x", 40)) + "--b--", opts: FormOptions{MaxFieldBytes: 64}, expectError: ErrorFormTooLarge},
+		{name: "too many parts", boundary: "b", body: strings.Repeat(part("a", "", "1"), 3) + "--b--", opts: FormOptions{MaxParts: 2}, expectError: ErrorFormTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.opts.TempDir = dir
+			_, err := ParseMultipart(strings.NewReader(tc.body), tc.boundary, tc.opts)
+			require.ErrorIs(t, err, tc.expectError)
+
+			// nothing is left behind on failure
+			spilled, _ := filepath.Glob(filepath.Join(dir, "*"))
+			assert.Empty(t, spilled)
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package request
 
-import "strings"
+import (
+	"net"
+	"net/url"
+	"strings"
+)
 
 var validMethods = map[string]bool{
 	"GET":     true,
@@ -10,22 +14,34 @@ var validMethods = map[string]bool{
 	"HEAD":    true,
 	"OPTIONS": true,
 	"PATCH":   true,
+	"CONNECT": true,
 }
 
 func isValidMethod(method string) bool {
 	return validMethods[method]
 }
 
-func isValidTarget(target string) bool {
-	if !strings.HasPrefix(target, "/") {
+// isValidTarget accepts the origin form ("/path") and the absolute form
+// ("http://host/path") sent to proxies. CONNECT takes the authority form
+// ("host:port") and nothing else.
+func isValidTarget(method, target string) bool {
+	if len(target) > 2048 {
 		return false
 	}
+	if method == "CONNECT" {
+		host, port, err := net.SplitHostPort(target)
+		return err == nil && host != "" && port != ""
+	}
 	if strings.Contains(target, "../") {
 		return false
 	}
-	if len(target) > 2048 {
-		return false
+	if strings.HasPrefix(target, "/") {
+		return true
 	}
+	return isAbsoluteForm(target)
+}
 
-	return true
+func isAbsoluteForm(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
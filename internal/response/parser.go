@@ -0,0 +1,410 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+)
+
+type parserState string
+
+const (
+	StateStatusLine parserState = "status-line"
+	StateHeaders    parserState = "headers"
+	StateBody       parserState = "body"
+	StateChunkSize  parserState = "chunk-size"
+	StateChunkData  parserState = "chunk-data"
+	StateChunkEnd   parserState = "chunk-end"
+	StateTrailers   parserState = "trailers"
+	StateUntilClose parserState = "until-close"
+	StateDone       parserState = "done"
+	StateError      parserState = "error"
+)
+
+var ErrorMalformedResponse = fmt.Errorf("malformed response")
+var ErrorResponseHeaderTooLarge = fmt.Errorf("response header too large")
+var ErrorResponseInErrorState = fmt.Errorf("response in error state")
+
+// DefaultMaxHeaderBytes is the default limit on the size of a status line
+// and headers together
+const DefaultMaxHeaderBytes = 1 << 20
+
+// maxChunkLineBytes limits a chunk size line
+const maxChunkLineBytes = 4096
+
+// maxInterimResponses limits the 1xx responses before the final one, as
+// net/http does, so a server cannot keep a client reading them forever
+const maxInterimResponses = 5
+
+// Parser decodes a response from bytes handed to it in pieces of any size,
+// the way the request parser does. Interim 1xx responses are collected
+// on the way to the final one; a 101 is final, and whatever follows it
+// belongs to the protocol switched to.
+type Parser struct {
+	// Body collects the decoded body as it is parsed. Callers streaming
+	// the body take what it holds between calls to Parse and empty it.
+	Body []byte
+	// MaxHeaderBytes limits each status line and header block.
+	// DefaultMaxHeaderBytes is used when it is zero.
+	MaxHeaderBytes int
+
+	method    string
+	state     parserState
+	res       *Response
+	interim   []*Response
+	version   string
+	headBytes int
+	// left is what remains of a Content-Length body or of the current chunk
+	left int64
+	// consumed is set once any byte has been parsed
+	consumed bool
+	// untilClose is set for a body that runs until the connection closes
+	untilClose bool
+}
+
+// NewParser returns a parser for the response to a request sent with
+// method, which tells a response to HEAD apart from one with a body
+func NewParser(method string) *Parser {
+	return &Parser{method: method, state: StateStatusLine}
+}
+
+// Response returns the final response once its head has been parsed and
+// nil before that. Its Body is left empty; the decoded body is in Body.
+func (p *Parser) Response() *Response {
+	if p.state == StateStatusLine || p.state == StateHeaders || p.state == StateError {
+		return nil
+	}
+	return p.res
+}
+
+// Interim returns the 1xx responses that came before the final one
+func (p *Parser) Interim() []*Response {
+	return p.interim
+}
+
+// HeadDone reports whether the head of the final response has been parsed
+func (p *Parser) HeadDone() bool {
+	return p.Response() != nil
+}
+
+func (p *Parser) Done() bool {
+	return p.state == StateDone
+}
+
+// KeepAlive reports whether the connection can carry another exchange
+// once the response is done: its body must not run until the connection
+// closes and neither side of HTTP/1.1 or HTTP/1.0 may have asked to
+// close it
+func (p *Parser) KeepAlive() bool {
+	if p.res == nil || p.res.StatusCode == StatusSwitchingProtocols || p.untilClose {
+		return false
+	}
+	if p.version == "HTTP/1.0" && !p.res.Headers.HasToken("Connection", "keep-alive") {
+		return false
+	}
+	return !p.res.Headers.HasToken("Connection", "close")
+}
+
+// EOF tells the parser that the connection has ended. A body delimited by
+// the close is complete; anywhere else mid-response it is
+// io.ErrUnexpectedEOF, and before the first byte io.EOF.
+func (p *Parser) EOF() error {
+	switch p.state {
+	case StateDone:
+		return nil
+	case StateUntilClose:
+		p.state = StateDone
+		return nil
+	case StateError:
+		return ErrorResponseInErrorState
+	case StateStatusLine:
+		if !p.consumed {
+			return io.EOF
+		}
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Parse consumes as much of data as it can and returns the number of bytes
+// used. Bytes it leaves are incomplete and must be offered again together
+// with more.
+func (p *Parser) Parse(data []byte) (int, error) {
+	n, err := p.parse(data)
+	if n > 0 {
+		p.consumed = true
+	}
+	if err != nil {
+		p.state = StateError
+		return 0, err
+	}
+	return n, nil
+}
+
+func (p *Parser) parse(data []byte) (int, error) {
+	read := 0
+outer:
+	for {
+		currentData := data[read:]
+		if len(currentData) == 0 && p.state != StateDone {
+			break outer
+		}
+		switch p.state {
+		case StateError:
+			return 0, ErrorResponseInErrorState
+
+		case StateStatusLine:
+			line, n, err := p.headLine(currentData)
+			if err != nil || n == 0 {
+				return read, err
+			}
+			read += n
+			if err := p.parseStatusLine(line); err != nil {
+				return 0, err
+			}
+			p.state = StateHeaders
+
+		case StateHeaders:
+			n, done, err := p.parseField(p.res.Headers, currentData)
+			if err != nil || n == 0 {
+				return read, err
+			}
+			read += n
+			if done {
+				if err := p.endHead(); err != nil {
+					return 0, err
+				}
+			}
+
+		case StateBody:
+			remaining := min(p.left, int64(len(currentData)))
+			p.Body = append(p.Body, currentData[:remaining]...)
+			p.left -= remaining
+			read += int(remaining)
+			if p.left == 0 {
+				p.state = StateDone
+			}
+
+		case StateChunkSize:
+			idx := bytes.IndexByte(currentData, '\n')
+			if idx == -1 {
+				if len(currentData) > maxChunkLineBytes {
+					return 0, ErrorMalformedResponse
+				}
+				break outer
+			}
+			sizeField, _, _ := strings.Cut(string(bytes.TrimSuffix(currentData[:idx], []byte("\r"))), ";")
+			size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+			if err != nil || size < 0 {
+				return 0, ErrorMalformedResponse
+			}
+			read += idx + 1
+			p.left = size
+			p.state = StateChunkData
+			if size == 0 {
+				p.headBytes = 0
+				p.state = StateTrailers
+			}
+
+		case StateChunkData:
+			remaining := min(p.left, int64(len(currentData)))
+			p.Body = append(p.Body, currentData[:remaining]...)
+			p.left -= remaining
+			read += int(remaining)
+			if p.left == 0 {
+				p.state = StateChunkEnd
+			}
+
+		case StateChunkEnd:
+			// every chunk's data ends with a line ending of its own
+			switch {
+			case currentData[0] == '\n':
+				read++
+			case currentData[0] != '\r':
+				return 0, ErrorMalformedResponse
+			case len(currentData) == 1:
+				break outer
+			case currentData[1] == '\n':
+				read += 2
+			default:
+				return 0, ErrorMalformedResponse
+			}
+			p.state = StateChunkSize
+
+		case StateTrailers:
+			n, done, err := p.parseField(p.res.Trailers, currentData)
+			if err != nil || n == 0 {
+				return read, err
+			}
+			read += n
+			if done {
+				p.state = StateDone
+			}
+
+		case StateUntilClose:
+			p.Body = append(p.Body, currentData...)
+			read += len(currentData)
+
+		case StateDone:
+			break outer
+		}
+	}
+	return read, nil
+}
+
+// headLine returns the next line of a head without its line ending, and
+// the bytes it took up. A bare LF is accepted as a line ending.
+func (p *Parser) headLine(data []byte) ([]byte, int, error) {
+	max := p.MaxHeaderBytes
+	if max <= 0 {
+		max = DefaultMaxHeaderBytes
+	}
+	idx := bytes.IndexByte(data, '\n')
+	if idx == -1 {
+		if p.headBytes+len(data) > max {
+			return nil, 0, ErrorResponseHeaderTooLarge
+		}
+		return nil, 0, nil
+	}
+	p.headBytes += idx + 1
+	if p.headBytes > max {
+		return nil, 0, ErrorResponseHeaderTooLarge
+	}
+	return bytes.TrimSuffix(data[:idx], []byte("\r")), idx + 1, nil
+}
+
+// parseField parses one header or trailer line into h and reports whether
+// it was the empty line that ends the block
+func (p *Parser) parseField(h *headers.Headers, data []byte) (int, bool, error) {
+	line, n, err := p.headLine(data)
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+	if len(line) == 0 {
+		return n, true, nil
+	}
+	field := append(append([]byte{}, line...), "\r\n"...)
+	if _, _, err := h.Parse(field); err != nil {
+		return 0, false, ErrorMalformedResponse
+	}
+	return n, false, nil
+}
+
+// parseStatusLine parses a line like "HTTP/1.1 200 OK" and starts a new
+// response
+func (p *Parser) parseStatusLine(line []byte) error {
+	parts := strings.SplitN(string(line), " ", 3)
+	if len(parts) < 2 || (parts[0] != "HTTP/1.1" && parts[0] != "HTTP/1.0") || len(parts[1]) != 3 {
+		return ErrorMalformedResponse
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || status < 100 || status > 599 {
+		return ErrorMalformedResponse
+	}
+
+	p.res = NewResponse(StatusCode(status))
+	p.res.Reason = ""
+	if len(parts) == 3 {
+		p.res.Reason = parts[2]
+	}
+	p.res.ContentLength = -1
+	p.version = parts[0]
+	return nil
+}
+
+// endHead works out how the body is framed, following RFC 9112 section
+// 6.3, once a header block is complete
+func (p *Parser) endHead() error {
+	res := p.res
+	p.headBytes = 0
+	status := res.StatusCode
+	switch {
+	case status < 200 && status != StatusSwitchingProtocols:
+		if len(p.interim) == maxInterimResponses {
+			return fmt.Errorf("%w: more than %d interim responses", ErrorMalformedResponse, maxInterimResponses)
+		}
+		p.interim = append(p.interim, res)
+		p.state = StateStatusLine
+		return nil
+	case status == StatusSwitchingProtocols:
+		p.state = StateDone
+		return nil
+	case p.method == "HEAD" || status == 204 || status == 304:
+		res.ContentLength = 0
+		p.state = StateDone
+		return nil
+	}
+
+	if te, ok := res.Headers.Get("Transfer-Encoding"); ok {
+		if strings.HasSuffix(strings.ToLower(strings.TrimSpace(te)), "chunked") {
+			p.state = StateChunkSize
+			return nil
+		}
+		p.untilClose = true
+		p.state = StateUntilClose
+		return nil
+	}
+
+	if cl, ok := res.Headers.Get("Content-Length"); ok {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 {
+			return ErrorMalformedResponse
+		}
+		res.ContentLength = n
+		p.left = n
+		p.state = StateBody
+		if n == 0 {
+			p.state = StateDone
+		}
+		return nil
+	}
+
+	p.untilClose = true
+	p.state = StateUntilClose
+	return nil
+}
+
+// ResponseFromReader reads a whole response to a request sent with method
+// from reader, body included, stopping at the end of the response or of
+// the reader
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	p := NewParser(method)
+	buf := make([]byte, 4096)
+	bufLen := 0
+	for !p.Done() {
+		if bufLen == len(buf) {
+			grown := make([]byte, 2*len(buf))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := reader.Read(buf[bufLen:])
+		bufLen += n
+		if n > 0 {
+			readN, perr := p.Parse(buf[:bufLen])
+			if perr != nil {
+				return nil, perr
+			}
+			copy(buf, buf[readN:bufLen])
+			bufLen -= readN
+		}
+		if err == io.EOF {
+			if bufLen > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if err := p.EOF(); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := p.Response()
+	res.Body = io.NopCloser(bytes.NewReader(p.Body))
+	return res, nil
+}
@@ -0,0 +1,230 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestResponseFromReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		method   string
+		status   StatusCode
+		reason   string
+		body     string
+		length   int64
+		header   [2]string
+		trailer  [2]string
+		interims int
+		err      error
+	}{
+		{
+			name:   "Content-Length",
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello, world!",
+			status: StatusOK,
+			reason: "OK",
+			body:   "hello, world!",
+			length: 13,
+		},
+		{
+			name:    "Chunked With Trailers",
+			input:   "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n7\r\n, world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+			status:  StatusOK,
+			reason:  "OK",
+			body:    "hello, world",
+			length:  -1,
+			trailer: [2]string{"X-Checksum", "abc"},
+		},
+		{
+			name:   "Close Delimited",
+			input:  "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end",
+			status: StatusOK,
+			reason: "OK",
+			body:   "until the end",
+			length: -1,
+			header: [2]string{"Content-Type", "text/plain"},
+		},
+		{
+			name:   "HEAD Has No Body",
+			input:  "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n",
+			method: "HEAD",
+			status: StatusOK,
+			reason: "OK",
+		},
+		{
+			name:   "204 Has No Body",
+			input:  "HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n",
+			status: 204,
+			reason: "No Content",
+		},
+		{
+			name:   "304 Has No Body",
+			input:  "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\n\r\n",
+			status: 304,
+			reason: "Not Modified",
+			header: [2]string{"ETag", `"v1"`},
+		},
+		{
+			name:     "Interim Responses",
+			input:    "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			status:   201,
+			reason:   "Created",
+			body:     "ok",
+			length:   2,
+			interims: 2,
+		},
+		{
+			name:   "Bare LF And No Reason",
+			input:  "HTTP/1.1 200\nContent-Length: 2\n\nok",
+			status: StatusOK,
+			body:   "ok",
+			length: 2,
+		},
+		{
+			name:     "Most Interim Responses Allowed",
+			input:    strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 5) + "HTTP/1.1 204 No Content\r\n\r\n",
+			status:   204,
+			reason:   "No Content",
+			interims: 5,
+		},
+		{name: "Too Many Interim Responses", input: strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 6) + "HTTP/1.1 204 No Content\r\n\r\n", err: ErrorMalformedResponse},
+		{name: "Empty", input: "", err: io.EOF},
+		{name: "Truncated Head", input: "HTTP/1.1 200 OK\r\nContent-", err: io.ErrUnexpectedEOF},
+		{name: "Truncated Body", input: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort", err: io.ErrUnexpectedEOF},
+		{name: "Truncated Chunk", input: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nabc", err: io.ErrUnexpectedEOF},
+		{name: "Unknown Version", input: "HTTP/2 200 OK\r\n\r\n", err: ErrorMalformedResponse},
+		{name: "Bad Status", input: "HTTP/1.1 2000 OK\r\n\r\n", err: ErrorMalformedResponse},
+		{name: "Bad Header", input: "HTTP/1.1 200 OK\r\nbad header\r\n\r\n", err: ErrorMalformedResponse},
+		{name: "Bad Content-Length", input: "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n", err: ErrorMalformedResponse},
+		{name: "Bad Chunk Size", input: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", err: ErrorMalformedResponse},
+		{name: "Chunk Overruns", input: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n", err: ErrorMalformedResponse},
+	}
+
+	for _, tc := range tests {
+		for _, size := range []int{1, 3, len(tc.input) + 1} {
+			t.Run(tc.name, func(t *testing.T) {
+				method := tc.method
+				if method == "" {
+					method = "GET"
+				}
+				res, err := ResponseFromReader(&chunkReader{data: tc.input, numBytesPerRead: size}, method)
+				if tc.err != nil {
+					assert.ErrorIs(t, err, tc.err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.status, res.StatusCode)
+				assert.Equal(t, tc.reason, res.Reason)
+				assert.Equal(t, tc.length, res.ContentLength)
+				body, err := io.ReadAll(res.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tc.body, string(body))
+				if tc.header[0] != "" {
+					v, _ := res.Headers.Get(tc.header[0])
+					assert.Equal(t, tc.header[1], v)
+				}
+				if tc.trailer[0] != "" {
+					v, _ := res.Trailers.Get(tc.trailer[0])
+					assert.Equal(t, tc.trailer[1], v)
+				}
+			})
+		}
+	}
+}
+
+func TestParserIncremental(t *testing.T) {
+	p := NewParser("GET")
+	input := []byte("HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n")
+
+	// an incomplete line is left for the next call
+	n, err := p.Parse(input[:10])
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = p.Parse(input)
+	require.NoError(t, err)
+	assert.Equal(t, len(input), n)
+	require.Len(t, p.Interim(), 1)
+	assert.Equal(t, StatusCode(103), p.Interim()[0].StatusCode)
+	require.True(t, p.HeadDone())
+	assert.Equal(t, "abc", string(p.Body))
+	assert.False(t, p.Done())
+
+	// the body is handed out as it arrives
+	p.Body = p.Body[:0]
+	n, err = p.Parse([]byte("0\r\n\r\nHTTP/1.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, p.Done())
+	assert.Empty(t, p.Body)
+	assert.True(t, p.KeepAlive())
+}
+
+func TestParserKeepAlive(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{name: "HTTP/1.1", input: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", want: true},
+		{name: "Server Closes", input: "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", want: false},
+		{name: "HTTP/1.0", input: "HTTP/1.0 200 OK\r\nContent-Length: 0\r\n\r\n", want: false},
+		{name: "HTTP/1.0 Keep-Alive", input: "HTTP/1.0 200 OK\r\nConnection: Keep-Alive\r\nContent-Length: 0\r\n\r\n", want: true},
+		{name: "Close Delimited", input: "HTTP/1.1 200 OK\r\n\r\n", want: false},
+		{name: "Switching Protocols", input: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewParser("GET")
+			_, err := p.Parse([]byte(tc.input))
+			require.NoError(t, err)
+			require.True(t, p.HeadDone())
+			require.NoError(t, p.EOF())
+			assert.Equal(t, tc.want, p.KeepAlive())
+		})
+	}
+}
+
+func TestParserInterimLimit(t *testing.T) {
+	p := NewParser("GET")
+	var err error
+	// a server that never gets past 100 Continue
+	for i := 0; err == nil && i < 100; i++ {
+		_, err = p.Parse([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	}
+	assert.ErrorIs(t, err, ErrorMalformedResponse)
+	assert.Len(t, p.Interim(), 5)
+}
+
+func TestParserHeaderLimit(t *testing.T) {
+	p := NewParser("GET")
+	p.MaxHeaderBytes = 64
+	_, err := p.Parse([]byte("HTTP/1.1 200 OK\r\nX-Padding: " + string(make([]byte, 64))))
+	assert.ErrorIs(t, err, ErrorResponseHeaderTooLarge)
+
+	_, err = p.Parse([]byte("\r\n"))
+	assert.ErrorIs(t, err, ErrorResponseInErrorState)
+}
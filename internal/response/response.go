@@ -4,69 +4,356 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"strconv"
+	"strings"
 
 	"github.com/AmiyoKm/httpfromtcp/internal/headers"
 )
 
 type StatusCode int
 
+type writerState string
+
+const (
+	stateStatusLine writerState = "status-line"
+	stateHeaders    writerState = "headers"
+	stateBody       writerState = "body"
+	stateTrailers   writerState = "trailers"
+	stateDone       writerState = "done"
+)
+
+// BodyFilter is consulted once, right before the header block is written.
+// It may edit the headers and return a writer that the body is streamed
+// through on its way to body. Returning nil leaves the response untouched.
+type BodyFilter func(status StatusCode, h *headers.Headers, body io.Writer) io.WriteCloser
+
+// ErrorNotHijackable is returned by Hijack when the connection behind the
+// writer cannot be handed over, as with HTTP/2 streams
+var ErrorNotHijackable = fmt.Errorf("connection cannot be hijacked")
+
+// ErrorHijacked is returned by writes on a Writer whose connection has
+// been hijacked, and by a second Hijack
+var ErrorHijacked = fmt.Errorf("connection has been hijacked")
+
+// ErrorAborted is returned by writes on a Writer after Abort
+var ErrorAborted = fmt.Errorf("response aborted")
+
+// Response is a response read by a client. Body is never nil; reading it
+// to the end fills in Trailers, and closing it releases the connection.
 type Response struct {
+	StatusCode StatusCode
+	Reason     string
+	Headers    *headers.Headers
+	Body       io.ReadCloser
+	Trailers   *headers.Headers
+	// ContentLength is the length of the body, -1 when it is not known up
+	// front
+	ContentLength int64
 }
+
 type Writer struct {
-	writer io.Writer
+	writer     io.Writer
+	sender     Sender
+	statusCode StatusCode
+	state      writerState
+	written    int
+	closeAfter bool
+	chunked    bool
+	err        error
+
+	filter  BodyFilter
+	encoder io.WriteCloser
+	// onHeaders run once before the final header block is written
+	onHeaders []func(status StatusCode, h *headers.Headers)
+
+	hijacker    func() (net.Conn, []byte, error)
+	hijacked    bool
+	aborted     bool
+	discardBody bool
 }
 
 func NewWriter(wc io.WriteCloser) *Writer {
 	return &Writer{
 		writer: wc,
+		state:  stateStatusLine,
+	}
+}
+
+// StatusCode returns the status sent with WriteStatusLine, or 0 if the
+// status line has not been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes sent to the client so far,
+// after any body filter and excluding chunk framing.
+func (w *Writer) BytesWritten() int {
+	return w.written
+}
+
+// KeepAlive reports whether the connection can carry another request once
+// this response is finished: the response must be framed, must not have
+// asked for the connection to be closed and every write must have succeeded.
+func (w *Writer) KeepAlive() bool {
+	return !w.hijacked && w.state == stateDone && !w.closeAfter && w.err == nil
+}
+
+// Err returns the first error hit while writing to the client
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// DiscardBody makes the writer drop the body and trailers while sending the
+// status line and headers unchanged, Content-Length included, as the
+// response to a HEAD request must. It must be called before the body is
+// written.
+func (w *Writer) DiscardBody() {
+	w.discardBody = true
+}
+
+// SetBodyFilter installs f for the response. It must be called before the
+// headers are written.
+func (w *Writer) SetBodyFilter(f BodyFilter) {
+	w.filter = f
+}
+
+// OnHeaders registers f to run right before the header block of the final
+// response is written, so middleware can add headers such as Set-Cookie
+// once the handler has picked a status. Hooks run in the order they were
+// registered, ahead of the body filter, and must be registered before the
+// headers are written.
+func (w *Writer) OnHeaders(f func(status StatusCode, h *headers.Headers)) {
+	w.onHeaders = append(w.onHeaders, f)
+}
+
+// SetHijacker is used by the server to let handlers take over the
+// connection with Hijack
+func (w *Writer) SetHijacker(h func() (net.Conn, []byte, error)) {
+	w.hijacker = h
+}
+
+// Hijack hands the raw connection to the caller along with any bytes the
+// server had already read past the request. The server no longer touches
+// the connection afterwards; closing it is up to the caller.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacker == nil {
+		return nil, nil, ErrorNotHijackable
+	}
+	if w.hijacked {
+		return nil, nil, ErrorHijacked
+	}
+	conn, buffered, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
 	}
+	w.hijacked = true
+	return conn, buffered, nil
+}
+
+// Abort ends the response as failed, so the client cannot mistake what it
+// got so far for a complete response: an HTTP/2 stream is reset and an
+// HTTP/1.1 connection is closed. Writes afterwards return ErrorAborted.
+func (w *Writer) Abort() error {
+	if w.hijacked {
+		return ErrorHijacked
+	}
+	if w.aborted {
+		return nil
+	}
+	w.aborted = true
+	w.state = stateDone
+	// a body filter would only try to flush into the dead response
+	w.encoder = nil
+	if w.err == nil {
+		w.err = ErrorAborted
+	}
+	if w.sender != nil {
+		return w.sender.Abort()
+	}
+	if c, ok := w.writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Hijacked reports whether Hijack has handed the connection over
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.sender != nil {
+		// the status goes out with the header block
+		w.statusCode = statusCode
+		w.state = stateHeaders
+		return nil
+	}
+
 	line := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase[statusCode])
 
-	_, err := w.writer.Write([]byte(line))
+	_, err := w.write([]byte(line))
 	if err != nil {
 		return err
 	}
+	w.statusCode = statusCode
+	w.state = stateHeaders
 	return nil
 }
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
+	h := &headers
+	if w.sender != nil {
+		return w.sendHeaders(h)
+	}
+	if w.state == stateTrailers {
+		w.state = stateDone
+		if w.discardBody {
+			return nil
+		}
+	} else {
+		h = w.applyFilter(h)
+		w.state = stateBody
+		w.closeAfter = !w.framed(h)
+		te, _ := h.Get("Transfer-Encoding")
+		w.chunked = strings.Contains(strings.ToLower(te), "chunked")
+	}
+
 	b := []byte{}
 
-	headers.ForEach(func(key, value string) {
+	h.ForEach(func(key, value string) {
 		slog.Info("WRITE#HEADERS ", "key", key, "value", value)
 		b = fmt.Appendf(b, "%s: %s\r\n", key, value)
 	})
 
 	b = fmt.Append(b, "\r\n")
-	_, err := w.writer.Write(b)
+	_, err := w.write(b)
+	return err
+}
+
+func (w *Writer) sendHeaders(h *headers.Headers) error {
+	var err error
+	if w.state == stateTrailers {
+		w.state = stateDone
+		if w.discardBody {
+			return nil
+		}
+		err = w.sender.SendTrailers(h)
+	} else {
+		h = w.applyFilter(h)
+		w.state = stateBody
+		err = w.sender.SendHeaders(w.statusCode, h)
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
 	return err
 }
 
+// framed reports whether the client can find the end of the body without
+// the connection being closed, and whether the headers allow reuse.
+func (w *Writer) framed(h *headers.Headers) bool {
+	if conn, ok := h.Get("Connection"); ok && strings.Contains(strings.ToLower(conn), "close") {
+		return false
+	}
+	if w.statusCode < 200 || w.statusCode == 204 || w.statusCode == 304 {
+		return true
+	}
+	if te, ok := h.Get("Transfer-Encoding"); ok {
+		return strings.Contains(strings.ToLower(te), "chunked")
+	}
+	_, ok := h.Get("Content-Length")
+	return ok
+}
+
+// applyFilter runs the OnHeaders hooks and the body filter, if any,
+// against a copy of h. When the filter takes over the body, the response
+// is switched to chunked framing because the final length is no longer
+// known.
+func (w *Writer) applyFilter(h *headers.Headers) *headers.Headers {
+	final := w.statusCode >= 200 || w.statusCode == StatusSwitchingProtocols
+	if w.filter == nil && (len(w.onHeaders) == 0 || !final) {
+		return h
+	}
+
+	h = h.Clone()
+	if final {
+		hooks := w.onHeaders
+		w.onHeaders = nil
+		for _, f := range hooks {
+			f(w.statusCode, h)
+		}
+	}
+	if w.filter == nil {
+		return h
+	}
+	w.encoder = w.filter(w.statusCode, h, chunkWriter{w})
+	if w.encoder == nil {
+		return h
+	}
+
+	h.Delete("Content-Length")
+	if te, _ := h.Get("Transfer-Encoding"); !strings.Contains(strings.ToLower(te), "chunked") {
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+	return h
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	n, err := w.writer.Write(p)
+	if w.discardBody {
+		return len(p), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	n, err := w.write(p)
+	w.written += n
 	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.discardBody {
+		return len(p), nil
+	}
+	if w.encoder != nil {
+		n, err := w.encoder.Write(p)
+		if err != nil {
+			return n, err
+		}
+		// flush so each chunk the handler sends reaches the client promptly
+		if f, ok := w.encoder.(interface{ Flush() error }); ok {
+			err = f.Flush()
+		}
+		return n, err
+	}
+	return w.writeChunk(p)
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if w.discardBody {
+		return len(p), nil
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if w.sender != nil {
+		n, err := w.write(p)
+		w.written += n
+		return n, err
+	}
 
 	chunkSize := fmt.Sprintf("%x\r\n", len(p))
-	_, err := w.writer.Write([]byte(chunkSize))
+	_, err := w.write([]byte(chunkSize))
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := w.writer.Write(p)
+	n, err := w.write(p)
+	w.written += n
 	if err != nil {
 		return n, err
 	}
 
-	_, err = w.writer.Write([]byte("\r\n"))
+	_, err = w.write([]byte("\r\n"))
 	if err != nil {
 		return n, err
 	}
@@ -75,25 +362,168 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
+
+	w.state = stateTrailers
+	if w.sender != nil || w.discardBody {
+		return 0, nil
+	}
 	finalChunk := []byte("0\r\n")
-	n, err := w.writer.Write(finalChunk)
+	return w.write(finalChunk)
+}
+
+// Finish completes a response the handler left open: it flushes a body
+// filter and terminates chunked bodies that were never closed. It is safe
+// to call more than once.
+func (w *Writer) Finish() error {
+	if w.hijacked {
+		return nil
+	}
+	if w.sender != nil {
+		return w.finishSender()
+	}
+
+	switch w.state {
+	case stateBody:
+		w.state = stateDone
+		if !w.chunked {
+			return nil
+		}
+		if err := w.closeEncoder(); err != nil || w.discardBody {
+			return err
+		}
+		_, err := w.write([]byte("0\r\n\r\n"))
+		return err
+	case stateTrailers:
+		w.state = stateDone
+		if w.discardBody {
+			return nil
+		}
+		_, err := w.write([]byte("\r\n"))
+		return err
+	}
+	return nil
+}
+
+func (w *Writer) finishSender() error {
+	switch w.state {
+	case stateDone:
+		return nil
+	case stateStatusLine:
+		return nil
+	case stateHeaders:
+		if err := w.sendHeaders(headers.NewHeaders()); err != nil {
+			return err
+		}
+	}
+
+	w.state = stateDone
+	if err := w.closeEncoder(); err != nil {
+		return err
+	}
+	return w.sender.Close()
+}
+
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+	enc := w.encoder
+	w.encoder = nil
+	return enc.Close()
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrorHijacked
+	}
+	if w.aborted {
+		return 0, ErrorAborted
+	}
+	if w.sender != nil {
+		n, err := w.sender.SendData(p)
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		return n, err
+	}
+	n, err := w.writer.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
 	return n, err
 }
 
+// chunkWriter frames everything written to it as a single chunk
+type chunkWriter struct {
+	w *Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.writeChunk(p)
+}
+
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusMovedPermanently            StatusCode = 301
+	StatusFound                       StatusCode = 302
+	StatusSeeOther                    StatusCode = 303
+	StatusTemporaryRedirect           StatusCode = 307
+	StatusPermanentRedirect           StatusCode = 308
+	StatusBadRequest                  StatusCode = 400
+	StatusUnauthorized                StatusCode = 401
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusRequestTimeout              StatusCode = 408
+	StatusPayloadTooLarge             StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusUpgradeRequired             StatusCode = 426
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
 var reasonPhrase = map[StatusCode]string{
-	StatusOK:                  "OK",
-	StatusBadRequest:          "Bad Request",
-	StatusInternalServerError: "Internal Server Error",
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusFound:                       "Found",
+	StatusSeeOther:                    "See Other",
+	StatusTemporaryRedirect:           "Temporary Redirect",
+	StatusPermanentRedirect:           "Permanent Redirect",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusProxyAuthRequired:           "Proxy Authentication Required",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusPayloadTooLarge:             "Payload Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
 }
 
-func NewResponse(staus StatusCode) *Response {
-	return &Response{}
+// NewResponse returns an empty response with status
+func NewResponse(status StatusCode) *Response {
+	return &Response{
+		StatusCode: status,
+		Reason:     reasonPhrase[status],
+		Headers:    headers.NewHeaders(),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Trailers:   headers.NewHeaders(),
+	}
 }
 
 func GetDefaultHeaders(contentLen int) *headers.Headers {
@@ -0,0 +1,28 @@
+package response
+
+import "github.com/AmiyoKm/httpfromtcp/internal/headers"
+
+// Sender carries a response over a protocol that does not use HTTP/1.1
+// framing, such as an HTTP/2 stream. A Writer built on a Sender keeps the
+// same API for handlers; chunked encoding is dropped because the protocol
+// delimits the body itself.
+type Sender interface {
+	// SendHeaders sends the status and header block
+	SendHeaders(status StatusCode, h *headers.Headers) error
+	// SendData sends part of the body
+	SendData(p []byte) (int, error)
+	// SendTrailers sends the trailer block and ends the response
+	SendTrailers(h *headers.Headers) error
+	// Close ends the response if it has not been ended yet
+	Close() error
+	// Abort ends the response as failed, such as with RST_STREAM
+	Abort() error
+}
+
+// NewSenderWriter returns a Writer that hands the response to s
+func NewSenderWriter(s Sender) *Writer {
+	return &Writer{
+		sender: s,
+		state:  stateStatusLine,
+	}
+}
@@ -0,0 +1,257 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentRest
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // the literal text, or the parameter name
+}
+
+type route struct {
+	pattern  string
+	method   string // empty matches any method
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers registered by method and path
+// pattern. It is itself usable as a server.Handler through Serve.
+type Router struct {
+	routes     []*route
+	middleware []server.Middleware
+	// chain is dispatch wrapped in middleware, rebuilt by Use
+	chain server.Handler
+	// NotFound is called when no pattern matches the path
+	NotFound server.Handler
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Use appends mw to the stack that wraps every request the router sees,
+// including the ones answered with 404 or 405.
+func (rt *Router) Use(mw ...server.Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+	rt.chain = server.Chain(rt.dispatch, rt.middleware...)
+}
+
+// Handle registers h for pattern, which is an optional method followed by a
+// path, e.g. "GET /users/{id}" or "/static/{path...}". A {name} segment
+// captures one path segment and a trailing {name...} captures the rest of
+// the path. Any mw given only wraps this route. Handle panics on malformed
+// or duplicate patterns.
+func (rt *Router) Handle(pattern string, h server.Handler, mw ...server.Middleware) {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	for _, existing := range rt.routes {
+		if existing.method == r.method && sameShape(existing.segments, r.segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+	r.handler = server.Chain(h, mw...)
+	rt.routes = append(rt.routes, r)
+}
+
+// Serve routes req to the most specific matching handler. GET routes also
+// serve HEAD, and the body of every response to HEAD is dropped. It answers
+// 405 with an Allow header when the path matches but the method does not,
+// and 404 when nothing matches.
+func (rt *Router) Serve(w *response.Writer, req *request.Request) {
+	if rt.chain == nil {
+		rt.dispatch(w, req)
+		return
+	}
+	rt.chain(w, req)
+}
+
+func (rt *Router) dispatch(w *response.Writer, req *request.Request) {
+	segments := splitPath(req.Path())
+	method := req.RequestLine.Method
+	if method == "HEAD" {
+		w.DiscardBody()
+	}
+
+	var best *route
+	var bestValues map[string]string
+	allowed := []string{}
+
+	for _, r := range rt.routes {
+		values, ok := r.match(segments)
+		if !ok {
+			continue
+		}
+		if !r.allows(method) {
+			if !slices.Contains(allowed, r.method) {
+				allowed = append(allowed, r.method)
+			}
+			continue
+		}
+		// a HEAD route beats the GET route of the same shape
+		if best == nil || r.moreSpecific(best) || (r.method == method && !best.moreSpecific(r)) {
+			best, bestValues = r, values
+		}
+	}
+
+	switch {
+	case best != nil:
+		for name, value := range bestValues {
+			req.SetPathValue(name, value)
+		}
+		best.handler(w, req)
+	case len(allowed) > 0:
+		if slices.Contains(allowed, "GET") && !slices.Contains(allowed, "HEAD") {
+			allowed = append(allowed, "HEAD")
+		}
+		slices.Sort(allowed)
+		body := []byte("method not allowed")
+		w.WriteStatusLine(response.StatusMethodNotAllowed)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	case rt.NotFound != nil:
+		rt.NotFound(w, req)
+	default:
+		server.HandlerError{StatusCode: response.StatusNotFound, Message: "not found"}.Write(w)
+	}
+}
+
+func parsePattern(pattern string) (*route, error) {
+	r := &route{pattern: pattern}
+
+	path := pattern
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		r.method = method
+		path = strings.TrimLeft(rest, " ")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("router: pattern %q must start with a path", pattern)
+	}
+
+	names := map[string]bool{}
+	parts := splitPath(path)
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("router: bad segment %q in pattern %q", part, pattern)
+			}
+			r.segments = append(r.segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := segmentParam
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: %s must be the last segment in pattern %q", part, pattern)
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = segmentRest
+		}
+		if name == "" || names[name] {
+			return nil, fmt.Errorf("router: bad or duplicate parameter %q in pattern %q", part, pattern)
+		}
+		names[name] = true
+		r.segments = append(r.segments, segment{kind: kind, value: name})
+	}
+
+	return r, nil
+}
+
+// splitPath breaks "/a/b" into ["a", "b"]; "/" becomes [""]
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func (r *route) match(parts []string) (map[string]string, bool) {
+	values := map[string]string{}
+
+	for i, seg := range r.segments {
+		if seg.kind == segmentRest {
+			values[seg.value] = unescape(strings.Join(parts[i:], "/"))
+			return values, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = unescape(parts[i])
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// allows reports whether the route serves method. GET routes serve HEAD too.
+func (r *route) allows(method string) bool {
+	return r.method == "" || r.method == method || (r.method == "GET" && method == "HEAD")
+}
+
+// moreSpecific reports whether r should win over other when both match.
+// Segments are compared left to right: a literal beats a parameter, which
+// beats a rest wildcard. A route bound to a method beats one that is not.
+func (r *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	return r.method != "" && other.method == ""
+}
+
+func sameShape(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind {
+			return false
+		}
+		if a[i].kind == segmentLiteral && a[i].value != b[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+func unescape(s string) string {
+	if v, err := url.PathUnescape(s); err == nil {
+		return v
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+// named returns a handler that answers with its own name and the captured params
+func named(name string, params ...string) func(w *response.Writer, r *request.Request) {
+	return func(w *response.Writer, r *request.Request) {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + r.PathValue(p)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func do(t *testing.T, rt *Router, method, target string) string {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	buf := &bufferCloser{}
+	rt.Serve(response.NewWriter(buf), req)
+	return buf.String()
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("get-user", "id"))
+	rt.Handle("DELETE /users/{id}", named("delete-user", "id"))
+	rt.Handle("GET /users/me", named("me"))
+	rt.Handle("/static/{path...}", named("static", "path"))
+	rt.Handle("/static/css/{file}", named("css", "file"))
+	rt.Handle("GET /", named("index"))
+
+	testCases := []struct {
+		name     string
+		method   string
+		target   string
+		expected string
+	}{
+		{name: "param", method: "GET", target: "/users/42", expected: "get-user id=42"},
+		{name: "method picks handler", method: "DELETE", target: "/users/42", expected: "delete-user id=42"},
+		{name: "literal beats param", method: "GET", target: "/users/me", expected: "me"},
+		{name: "query string ignored", method: "GET", target: "/users/7?verbose=1", expected: "get-user id=7"},
+		{name: "escaped param", method: "GET", target: "/users/a%20b", expected: "get-user id=a b"},
+		{name: "rest wildcard", method: "GET", target: "/static/js/app/main.js", expected: "static path=js/app/main.js"},
+		{name: "rest wildcard empty", method: "POST", target: "/static/", expected: "static path="},
+		{name: "param beats rest", method: "GET", target: "/static/css/site.css", expected: "css file=site.css"},
+		{name: "root", method: "GET", target: "/", expected: "index"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := do(t, rt, tc.method, tc.target)
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+			assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+tc.expected), out)
+		})
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("get-user", "id"))
+	rt.Handle("PUT /users/{id}", named("put-user", "id"))
+
+	out := do(t, rt, "POST", "/users/42")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+	assert.Contains(t, out, "allow: GET, HEAD, PUT\r\n")
+
+	out = do(t, rt, "GET", "/users")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+
+	out = do(t, rt, "GET", "/users/")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+
+	rt.NotFound = named("custom")
+	out = do(t, rt, "GET", "/nope")
+	assert.True(t, strings.HasSuffix(out, "custom"), out)
+}
+
+func TestRouterHead(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("get-user", "id"))
+	rt.Handle("/{path...}", named("catch-all"))
+
+	// the GET route serves HEAD, with the headers of the GET response and
+	// no body
+	out := do(t, rt, "HEAD", "/users/42")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.Contains(t, out, "content-length: 14\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), out)
+	assert.NotContains(t, out, "get-user")
+
+	// a HEAD route is preferred over the GET route of the same pattern
+	rt.Handle("HEAD /probe", func(w *response.Writer, r *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Replace("X-Route", "head")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+	})
+	rt.Handle("GET /probe", named("get-probe"))
+	out = do(t, rt, "HEAD", "/probe")
+	assert.Contains(t, out, "x-route: head\r\n")
+}
+
+func TestRouterHeadAllowed(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("get-user", "id"))
+
+	out := do(t, rt, "DELETE", "/users/42")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+	assert.Contains(t, out, "allow: GET, HEAD\r\n")
+}
+
+func TestHandleRejectsBadPatterns(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", named("a"))
+
+	assert.Panics(t, func() { rt.Handle("GET /users/{name}", named("b")) })
+	assert.Panics(t, func() { rt.Handle("/files/{path...}/edit", named("c")) })
+	assert.Panics(t, func() { rt.Handle("/a/{x}/{x}", named("d")) })
+	assert.Panics(t, func() { rt.Handle("users", named("e")) })
+	assert.NotPanics(t, func() { rt.Handle("POST /users/{name}", named("f")) })
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	tag := func(value string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, r *request.Request) {
+				r.SetPathValue("tags", r.PathValue("tags")+value)
+				next(w, r)
+			}
+		}
+	}
+
+	rt := New()
+	rt.Use(tag("g"))
+	rt.Handle("/plain", named("plain", "tags"))
+	rt.Handle("/extra", named("extra", "tags"), tag("r1"), tag("r2"))
+
+	out := do(t, rt, "GET", "/plain")
+	assert.True(t, strings.HasSuffix(out, "plain tags=g"), out)
+
+	out = do(t, rt, "GET", "/extra")
+	assert.True(t, strings.HasSuffix(out, "extra tags=gr1r2"), out)
+
+	// the global stack is built when it changes, not on every request
+	builds := 0
+	rt.Use(func(next server.Handler) server.Handler {
+		builds++
+		return next
+	})
+	for range 3 {
+		do(t, rt, "GET", "/plain")
+	}
+	assert.Equal(t, 1, builds)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func protoHandler(w *response.Writer, r *request.Request) {
+	body := []byte("HTTP/" + r.RequestLine.HttpVersion + " " + r.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	s := &Server{Handler: protoHandler, EnableHTTP2: true}
+	go s.Serve(l)
+	defer s.Close()
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, body := get(t, h2c, "http://"+l.Addr().String()+"/h2c")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "HTTP/2 /h2c", body)
+
+	// plain HTTP/1.1 still works on the same listener
+	resp, body = get(t, &http.Client{}, "http://"+l.Addr().String()+"/plain")
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "HTTP/1.1 /plain", body)
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	certPEM, keyPEM := selfSigned(t, "h2", "localhost")
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	store := NewCertStore()
+	require.NoError(t, store.Add(pair))
+
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	s := &Server{Handler: protoHandler, TLSConfig: store.TLSConfig(), EnableHTTP2: true}
+	go s.Serve(l)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, body := get(t, client, "https://"+l.Addr().String()+"/alpn")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "HTTP/2 /alpn", body)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+}
+
+func TestHTTP2ShutdownSendsGoAway(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		close(entered)
+		<-release
+		protoHandler(w, r)
+	}, EnableHTTP2: true}
+	go s.Serve(l)
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result)
+	go func() {
+		resp, err := h2c.Get("http://" + l.Addr().String() + "/drain")
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		got <- result{string(body), err}
+	}()
+	<-entered
+
+	shutdown := make(chan error)
+	go func() {
+		_, err := s.Shutdown(context.Background())
+		shutdown <- err
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned while a stream was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	res := <-got
+	require.NoError(t, res.err)
+	assert.Equal(t, "HTTP/2 /drain", res.body)
+	assert.NoError(t, <-shutdown)
+
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,14 @@
+package server
+
+// Middleware wraps a Handler with behaviour that runs around it, such as
+// logging, authentication or compression.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with mw. The first middleware listed is the outermost, so it
+// sees the request first and the finished response last.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
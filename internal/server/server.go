@@ -1,21 +1,146 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/AmiyoKm/httpfromtcp/internal/http2"
 	"github.com/AmiyoKm/httpfromtcp/internal/request"
 	"github.com/AmiyoKm/httpfromtcp/internal/response"
 )
 
+const (
+	DefaultAddr              = ":42069"
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = 60 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe once the server
+// has been shut down or closed
+var ErrServerClosed = errors.New("server closed")
+
+// ErrClientGone is the cause of a request context cancelled because the
+// client closed the connection or a write to it failed
+var ErrClientGone = errors.New("client went away")
+
+// ConnState describes where a connection is in its life, as reported to the
+// Server.ConnState hook
+type ConnState int
+
+const (
+	// StateNew is a freshly accepted connection
+	StateNew ConnState = iota
+	// StateActive is a connection reading a request or running the handler
+	StateActive
+	// StateIdle is a keep-alive connection waiting for its next request
+	StateIdle
+	// StateClosed is a connection the server has finished with
+	StateClosed
+	// StateHijacked is a connection a handler took over with Hijack. The
+	// server no longer tracks it, so it is never reported as closed and
+	// Shutdown does not wait for it.
+	StateHijacked
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	case StateHijacked:
+		return "hijacked"
+	}
+	return "unknown"
+}
+
+// Server serves HTTP/1.1 connections, and HTTP/2 ones when EnableHTTP2 is
+// set. The zero value is usable once Handler
+// is set; every other field is optional and must not be changed after the
+// server has started.
 type Server struct {
+	// Addr is the TCP address ListenAndServe listens on, DefaultAddr if empty
+	Addr    string
+	Handler Handler
+
+	// ReadHeaderTimeout bounds the time from the first byte of a request to
+	// the end of its header block. Zero means no limit.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds the time from the first byte of a request to the end
+	// of its body. Zero means no limit.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds the time the handler has to write its response.
+	// Zero means no limit.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection may wait for the next
+	// request. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxHeaderBytes limits the request line and headers together,
+	// request.DefaultMaxHeaderBytes when zero
+	MaxHeaderBytes int
+	// MaxBodyBytes limits the Content-Length a request may declare. Zero
+	// means no limit, except over HTTP/2 where http2.DefaultMaxBodyBytes
+	// applies.
+	MaxBodyBytes int
+
+	// TLSConfig, when set, makes Serve and ListenAndServe accept TLS
+	// connections only
+	TLSConfig *tls.Config
+
+	// Logger receives accept errors and recovered panics, slog.Default()
+	// when nil
+	Logger *slog.Logger
+	// ErrorHandler writes the response for requests the server rejects
+	// itself: malformed or oversized requests, timeouts and handler panics.
+	// req is nil when the request could not be parsed. HandlerError.Write
+	// is used when nil.
+	ErrorHandler func(w *response.Writer, req *request.Request, herr HandlerError)
+	// ConnState, when set, is called every time a connection changes state
+	ConnState func(net.Conn, ConnState)
+
+	// EnableHTTP2 serves HTTP/2 as well: negotiated with ALPN on TLS
+	// connections and spoken with prior knowledge (h2c) on plaintext ones
+	EnableHTTP2 bool
+	// MaxConcurrentStreams limits the streams an HTTP/2 client may have
+	// open, http2.DefaultMaxConcurrentStreams when zero
+	MaxConcurrentStreams uint32
+
 	listener net.Listener
-	handler  Handler
 	closed   atomic.Bool
+	// baseCtx is the parent of every request context. It is cancelled by
+	// Close, or by Shutdown once its deadline passes.
+	baseCtx    context.Context
+	cancelBase context.CancelCauseFunc
+	// inShutdown is closed with the listener, which makes HTTP/2
+	// connections send GOAWAY without cancelling their requests
+	inShutdown  chan struct{}
+	baseCtxOnce sync.Once
+
+	mu    sync.Mutex
+	conns map[net.Conn]ConnState
 }
 
-// Serve creates a new server listening on the specified port
+// Serve creates a new server listening on the specified port with the
+// default timeouts and starts serving in the background
 func Serve(port int, handler Handler) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -23,54 +148,517 @@ func Serve(port int, handler Handler) (*Server, error) {
 	}
 
 	server := &Server{
-		listener: listener,
-		handler:  handler,
+		Handler:           handler,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		ReadTimeout:       DefaultReadTimeout,
+		WriteTimeout:      DefaultWriteTimeout,
+		IdleTimeout:       DefaultIdleTimeout,
 	}
-	server.closed.Store(false)
 
 	// Start listening in a goroutine
-	go server.listen()
+	go server.Serve(listener)
 
 	return server, nil
 }
 
-// Close shuts down the server by closing the listener
-func (s *Server) Close() error {
-	s.closed.Store(true)
-	return s.listener.Close()
+// ListenAndServe listens on s.Addr and serves connections until the server
+// is shut down
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// ListenAndServeTLS is ListenAndServe over TLS. When s.TLSConfig is nil the
+// certificate and key are loaded from the given files into a CertStore.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.TLSConfig == nil {
+		store := NewCertStore()
+		if err := store.AddFiles(certFile, keyFile); err != nil {
+			return err
+		}
+		s.TLSConfig = store.TLSConfig()
+	}
+	return s.ListenAndServe()
 }
 
-// listen accepts connections and handles them in separate goroutines
-func (s *Server) listen() {
+// minAcceptDelay and maxAcceptDelay bound the backoff after a failed Accept
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Serve accepts connections on listener and handles each in its own
+// goroutine until the server is shut down. Failed accepts are retried with
+// a growing delay. It always returns a non-nil error, ErrServerClosed after
+// Shutdown or Close.
+func (s *Server) Serve(listener net.Listener) error {
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig())
+	}
+
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if s.closed.Load() {
-				return
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// running out of file descriptors and the like pass, so back
+			// off and keep accepting rather than taking the server down
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.logger().Error("error accepting connection", "err", err, "retry_in", delay)
+			select {
+			case <-time.After(delay):
+			case <-s.shuttingDown():
 			}
-			fmt.Printf("Error accepting connection: %v\n", err)
 			continue
 		}
+		delay = 0
 
 		// Handle each connection in a separate goroutine
+		s.setConnState(conn, StateNew)
 		go s.handle(conn)
 	}
 }
 
-// handle processes a single connection
+// ListenAddr returns the address the server is listening on, or nil before Serve
+// has been called
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// tlsConfig returns TLSConfig, advertising h2 over ALPN when HTTP/2 is
+// enabled
+func (s *Server) tlsConfig() *tls.Config {
+	if !s.EnableHTTP2 || slices.Contains(s.TLSConfig.NextProtos, "h2") {
+		return s.TLSConfig
+	}
+	cfg := s.TLSConfig.Clone()
+	cfg.NextProtos = append([]string{"h2"}, cfg.NextProtos...)
+	if !slices.Contains(cfg.NextProtos, "http/1.1") {
+		cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+	}
+	return cfg
+}
+
+func (s *Server) baseContext() context.Context {
+	s.baseCtxOnce.Do(func() {
+		s.baseCtx, s.cancelBase = context.WithCancelCause(context.Background())
+		s.inShutdown = make(chan struct{})
+	})
+	return s.baseCtx
+}
+
+func (s *Server) shuttingDown() chan struct{} {
+	s.baseContext()
+	return s.inShutdown
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Server) closeListener() error {
+	if !s.closed.Swap(true) {
+		close(s.shuttingDown())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Close shuts down the server immediately, closing the listener and every
+// open connection. Use Shutdown to let in-flight requests finish.
+func (s *Server) Close() error {
+	err := s.closeListener()
+	s.cancelBase(ErrServerClosed)
+	s.closeAllConns()
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks for connections that
+// have gone idle or finished
+const shutdownPollInterval = 20 * time.Millisecond
+
+// Shutdown stops the server gracefully. It stops accepting connections,
+// closes idle keep-alive connections and waits for active ones to finish
+// their current request. Request contexts stay live while they do. If ctx
+// ends first, the request contexts are cancelled, the remaining connections
+// are closed and their number is returned along with ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	err := s.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelBase(ErrServerClosed)
+			return s.closeAllConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes connections waiting for a request and reports
+// whether no connections are left. A connection stays counted until its
+// handler has reported it closed.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, state := range s.conns {
+		if state == StateIdle || state == StateNew {
+			s.conns[conn] = StateClosed
+			conn.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// closeAllConns closes every connection and returns how many were still
+// open
+func (s *Server) closeAllConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for conn, state := range s.conns {
+		if state != StateClosed {
+			n++
+			s.conns[conn] = StateClosed
+			conn.Close()
+		}
+	}
+	return n
+}
+
+// setConnState records that conn moved to state and reports whether it
+// did. A connection the server has already closed cannot become active or
+// idle again; the move to StateClosed or StateHijacked is reported to the
+// ConnState hook before the connection is forgotten, so Shutdown does not
+// return ahead of it.
+func (s *Server) setConnState(conn net.Conn, state ConnState) bool {
+	s.mu.Lock()
+	if state != StateClosed && state != StateHijacked {
+		if s.conns[conn] == StateClosed {
+			s.mu.Unlock()
+			return false
+		}
+		if s.conns == nil {
+			s.conns = map[net.Conn]ConnState{}
+		}
+		s.conns[conn] = state
+	}
+	s.mu.Unlock()
+
+	if s.ConnState != nil {
+		s.ConnState(conn, state)
+	}
+	if state == StateClosed || state == StateHijacked {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}
+	return true
+}
+
+// handle processes a single connection, serving requests on it until the
+// client or a response asks for it to be closed, a timeout fires or a
+// handler hijacks it
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	hijacked := false
+	defer func() {
+		// a hijacked connection belongs to the handler now
+		if hijacked {
+			return
+		}
+		s.setConnState(conn, StateClosed)
+		conn.Close()
+	}()
+
+	reader := request.NewReader(conn)
+	reader.MaxHeaderBytes = s.MaxHeaderBytes
+	reader.MaxBodyBytes = s.MaxBodyBytes
+	var start time.Time
+	reader.OnHeaders = func(*request.Request) {
+		setDeadline(conn.SetReadDeadline, start, s.ReadTimeout)
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && s.EnableHTTP2 {
+		setDeadline(conn.SetDeadline, time.Now(), s.ReadHeaderTimeout)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			conn.SetDeadline(time.Time{})
+			s.serveHTTP2(conn, nil)
+			return
+		}
+	}
+
+	for first := true; ; first = false {
+		if !first {
+			if s.closed.Load() || !s.setConnState(conn, StateIdle) {
+				return
+			}
+		}
+
+		// the first request gets the header timeout to show up, later ones
+		// the idle timeout
+		wait := s.IdleTimeout
+		if first {
+			wait = s.ReadHeaderTimeout
+		}
+		setDeadline(conn.SetReadDeadline, time.Now(), wait)
+		if err := reader.Wait(); err != nil {
+			return
+		}
+
+		// Shutdown may have closed the connection while it was idle
+		if !s.setConnState(conn, StateActive) {
+			return
+		}
+		if first && s.EnableHTTP2 && hasPreface(reader) {
+			conn.SetReadDeadline(time.Time{})
+			s.serveHTTP2(conn, reader.Buffered())
+			return
+		}
+		start = time.Now()
+		var keepAlive bool
+		keepAlive, hijacked = s.serveRequest(conn, reader, start)
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// hasPreface reports whether the connection opens with the HTTP/2 client
+// preface. It reads only as far as needed to tell an HTTP/1.1 request apart.
+func hasPreface(reader *request.Reader) bool {
+	preface := http2.ClientPreface
+	for n := 1; ; {
+		b, err := reader.Peek(n)
+		if len(b) >= len(preface) {
+			return string(b[:len(preface)]) == preface
+		}
+		if !strings.HasPrefix(preface, string(b)) || err != nil {
+			return false
+		}
+		n = len(b) + 1
+	}
+}
+
+// serveHTTP2 hands the connection to the HTTP/2 server until it is done
+func (s *Server) serveHTTP2(conn net.Conn, buffered []byte) {
+	err := http2.ServeConn(conn, buffered, http2.Handler(s.Handler), http2.Config{
+		MaxConcurrentStreams: s.MaxConcurrentStreams,
+		MaxHeaderBytes:       s.MaxHeaderBytes,
+		MaxBodyBytes:         s.MaxBodyBytes,
+		IdleTimeout:          s.IdleTimeout,
+		Logger:               s.Logger,
+		Context:              s.baseContext(),
+		Shutdown:             s.shuttingDown(),
+	})
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		s.logger().Debug("http2 connection ended", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// serveRequest reads one request from reader and runs the handler for it.
+// It reports whether the connection can be used for another request and
+// whether the handler took it over.
+func (s *Server) serveRequest(conn net.Conn, reader *request.Reader, start time.Time) (keepAlive, hijacked bool) {
+	ctx, cancel := context.WithCancelCause(s.baseContext())
+	defer cancel(nil)
+
+	stopWatch := func() {}
+	defer func() { stopWatch() }()
+
+	responseWriter := response.NewWriter(cancelOnError{conn, cancel})
+	responseWriter.SetHijacker(func() (net.Conn, []byte, error) {
+		stopWatch()
+		conn.SetDeadline(time.Time{})
+		s.setConnState(conn, StateHijacked)
+		return conn, reader.Buffered(), nil
+	})
+
+	var req *request.Request
+	defer func() {
+		if v := recover(); v != nil {
+			s.recoverPanic(v, conn, responseWriter, req)
+			keepAlive = false
+		}
+		hijacked = responseWriter.Hijacked()
+	}()
 
-	responseWriter := response.NewWriter(conn)
+	headerTimeout := s.ReadHeaderTimeout
+	if headerTimeout == 0 || (s.ReadTimeout != 0 && s.ReadTimeout < headerTimeout) {
+		headerTimeout = s.ReadTimeout
+	}
+	setDeadline(conn.SetReadDeadline, start, headerTimeout)
+
+	req, err := reader.ReadRequest()
+	setDeadline(conn.SetWriteDeadline, time.Now(), s.WriteTimeout)
+	if err != nil {
+		s.writeError(responseWriter, nil, readError(err))
+		return false, false
+	}
+	conn.SetReadDeadline(time.Time{})
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	if s.WriteTimeout != 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.WriteTimeout)
+		defer cancelTimeout()
+	}
+	req = req.WithContext(ctx)
+	defer req.RemoveForm()
+	stopWatch = watchConn(conn, reader, cancel)
+
+	s.Handler(responseWriter, req)
+	stopWatch()
+	if responseWriter.Hijacked() {
+		return false, true
+	}
+	responseWriter.Finish()
+
+	if conn, ok := req.Headers.Get("Connection"); ok && strings.Contains(strings.ToLower(conn), "close") {
+		return false, false
+	}
+	return responseWriter.KeepAlive(), false
+}
+
+// aLongTimeAgo is a read deadline that wakes a blocked read immediately
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchConn cancels the request context when the client closes the
+// connection while the handler runs. The returned function stops the watch
+// and must be called before reader is used again; it is safe to call more
+// than once. Bytes that arrive meanwhile, such as a pipelined request, stay
+// buffered in reader.
+func watchConn(conn net.Conn, reader *request.Reader, cancel context.CancelCauseFunc) func() {
+	var stopping atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := reader.Wait(); err != nil && !stopping.Load() {
+			cancel(ErrClientGone)
+		}
+	}()
 
-	req, err := request.RequestFromReader(conn)
+	return sync.OnceFunc(func() {
+		stopping.Store(true)
+		conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// cancelOnError cancels the request context once a write to the client
+// fails, so handlers streaming a response notice it through the context
+type cancelOnError struct {
+	net.Conn
+	cancel context.CancelCauseFunc
+}
+
+func (c cancelOnError) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
 	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(*response.GetDefaultHeaders(0))
+		c.cancel(errors.Join(ErrClientGone, err))
+	}
+	return n, err
+}
+
+// readError maps a failure to read a request to the response it deserves
+func readError(err error) HandlerError {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return HandlerError{StatusCode: response.StatusRequestTimeout, Message: "request timeout"}
+	case errors.Is(err, request.ErrorRequestHeaderTooLarge):
+		return HandlerError{StatusCode: response.StatusRequestHeaderFieldsTooLarge, Message: err.Error()}
+	case errors.Is(err, request.ErrorRequestBodyTooLarge):
+		return HandlerError{StatusCode: response.StatusPayloadTooLarge, Message: err.Error()}
+	}
+	return HandlerError{StatusCode: response.StatusBadRequest, Message: "bad request"}
+}
+
+func (s *Server) writeError(w *response.Writer, req *request.Request, herr HandlerError) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(w, req, herr)
 		return
 	}
+	herr.Write(w)
+}
 
-	s.handler(responseWriter, req)
+// setDeadline sets a deadline d after from, or clears it when d is zero
+func setDeadline(set func(time.Time) error, from time.Time, d time.Duration) {
+	if d == 0 {
+		set(time.Time{})
+		return
+	}
+	set(from.Add(d))
+}
+
+// recoverPanic logs a panic raised while serving conn and answers with a 500
+// if nothing has reached the client yet. A partly written response cannot be
+// repaired, so in that case the connection is simply closed by handle.
+func (s *Server) recoverPanic(v any, conn net.Conn, w *response.Writer, req *request.Request) {
+	attrs := []any{
+		"panic", v,
+		"remote", conn.RemoteAddr().String(),
+		"stack", string(debug.Stack()),
+	}
+	if req != nil {
+		attrs = append(attrs, "method", req.RequestLine.Method, "target", req.RequestLine.RequestTarget)
+	}
+	s.logger().Error("panic serving connection", attrs...)
+
+	if w.StatusCode() != 0 || w.Hijacked() {
+		return
+	}
+	s.writeError(w, req, HandlerError{
+		StatusCode: response.StatusInternalServerError,
+		Message:    "internal server error",
+	})
 }
 
 type HandlerError struct {
@@ -78,4 +666,17 @@ type HandlerError struct {
 	Message    string
 }
 
+// Write sends the error to the client as a plain text response
+func (he HandlerError) Write(w *response.Writer) error {
+	body := []byte(he.Message)
+	if err := w.WriteStatusLine(he.StatusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*response.GetDefaultHeaders(len(body))); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
+
 type Handler func(w *response.Writer, req *request.Request)
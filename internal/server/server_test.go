@@ -0,0 +1,582 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip serves a single connection with h over an in-memory pipe and
+// returns everything the server wrote before closing it.
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.handle(conn)
+		close(done)
+	}()
+
+	go client.Write([]byte(raw))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	<-done
+	return string(out)
+}
+
+func TestHandleRecoversHandlerPanic(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		panic("boom")
+	}}
+
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "internal server error"), out)
+}
+
+func TestHandleRejectsAmbiguousBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{
+			name: "chunked body smuggling a second request",
+			raw: "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		},
+		{
+			name: "transfer-encoding and content-length",
+			raw: "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		},
+		{
+			name: "negative content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: -5\r\n\r\nabc",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{Handler: keepAliveHandler}
+			out := roundTrip(t, s, tc.raw)
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+			assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 "), out)
+			assert.NotContains(t, out, "you asked for")
+		})
+	}
+}
+
+func TestHandleClosesPartlyWrittenResponse(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(100))
+		w.WriteBody([]byte("partial"))
+		panic("halfway")
+	}}
+
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "partial"), out)
+	assert.NotContains(t, out, "500")
+}
+
+func keepAliveHandler(w *response.Writer, r *request.Request) {
+	body := []byte("you asked for " + r.RequestLine.RequestTarget)
+	h := response.GetDefaultHeaders(len(body))
+	h.Delete("Connection")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func TestHandleKeepAlive(t *testing.T) {
+	s := &Server{Handler: keepAliveHandler, IdleTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	out := roundTrip(t, s, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.Contains(t, out, "you asked for /one")
+	assert.Contains(t, out, "you asked for /two")
+	// the idle timeout is what finally closed the connection
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestHandleConnectionClose(t *testing.T) {
+	s := &Server{Handler: keepAliveHandler}
+
+	out := roundTrip(t, s, "GET /one HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"), out)
+	assert.NotContains(t, out, "/two")
+}
+
+func TestHandleSlowHeaders(t *testing.T) {
+	s := &Server{Handler: keepAliveHandler, ReadHeaderTimeout: 50 * time.Millisecond}
+
+	client, conn := net.Pipe()
+	go s.handle(conn)
+
+	// one byte now, the rest never
+	_, err := client.Write([]byte("G"))
+	require.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"), string(out))
+}
+
+func TestHandleSlowBody(t *testing.T) {
+	s := &Server{
+		Handler:           keepAliveHandler,
+		ReadHeaderTimeout: time.Second,
+		ReadTimeout:       50 * time.Millisecond,
+	}
+
+	client, conn := net.Pipe()
+	go s.handle(conn)
+
+	_, err := client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"), string(out))
+}
+
+func TestHandleIdleConnectionClosedSilently(t *testing.T) {
+	s := &Server{Handler: keepAliveHandler, ReadHeaderTimeout: 50 * time.Millisecond}
+
+	client, conn := net.Pipe()
+	go s.handle(conn)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func listenLoopback() (net.Listener, error) {
+	return net.Listen("tcp", "127.0.0.1:0")
+}
+
+// startServer serves h on a loopback listener and returns the address
+func startServer(t *testing.T, h Handler) (*Server, string) {
+	l, err := listenLoopback()
+	require.NoError(t, err)
+
+	s := &Server{Handler: h}
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+func TestShutdownWaitsForActiveRequests(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ctxErr := make(chan error, 1)
+	s, addr := startServer(t, func(w *response.Writer, r *request.Request) {
+		close(entered)
+		<-release
+		ctxErr <- r.Context().Err()
+		keepAliveHandler(w, r)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+
+	// an idle connection should be closed straight away
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	type result struct {
+		dropped int
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		dropped, err := s.Shutdown(context.Background())
+		done <- result{dropped, err}
+	}()
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a request was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "you asked for /slow")
+	// the request is allowed to finish, so its context must not be cancelled
+	assert.NoError(t, <-ctxErr)
+
+	res := <-done
+	assert.NoError(t, res.err)
+	assert.Equal(t, 0, res.dropped)
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+}
+
+func TestShutdownDropsConnectionsAtDeadline(t *testing.T) {
+	entered := make(chan struct{})
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+	s, addr := startServer(t, func(w *response.Writer, r *request.Request) {
+		close(entered)
+		<-stuck
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /stuck HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	dropped, err := s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, dropped)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+}
+
+func TestShutdownClosedConnStaysClosed(t *testing.T) {
+	s := &Server{}
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	// Shutdown closes the connection while it waits for a request, so the
+	// request arriving right after cannot make it active again
+	require.True(t, s.setConnState(conn, StateNew))
+	assert.False(t, s.closeIdleConns())
+	assert.False(t, s.setConnState(conn, StateActive))
+	assert.False(t, s.setConnState(conn, StateIdle))
+	assert.Equal(t, 0, s.closeAllConns())
+
+	// it is forgotten once its handler reports it closed
+	s.setConnState(conn, StateClosed)
+	assert.True(t, s.closeIdleConns())
+}
+
+// memListener is an in-memory net.Listener handing out net.Pipe connections
+type memListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return memAddr{} }
+
+func (l *memListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
+
+func TestServeOnSuppliedListener(t *testing.T) {
+	l := newMemListener()
+	states := make(chan ConnState, 16)
+	s := &Server{
+		Handler: keepAliveHandler,
+		ConnState: func(_ net.Conn, state ConnState) {
+			states <- state
+		},
+	}
+
+	served := make(chan error)
+	go func() { served <- s.Serve(l) }()
+
+	conn, err := l.Dial()
+	require.NoError(t, err)
+	go conn.Write([]byte("GET /mem HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "you asked for /mem")
+
+	_, err = s.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+
+	close(states)
+	seen := []ConnState{}
+	for state := range states {
+		seen = append(seen, state)
+	}
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateClosed}, seen)
+}
+
+// failingListener fails the first failures calls to Accept
+type failingListener struct {
+	*memListener
+	failures int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, syscall.EMFILE
+	}
+	return l.memListener.Accept()
+}
+
+func TestServeRetriesAcceptErrors(t *testing.T) {
+	l := &failingListener{memListener: newMemListener(), failures: 3}
+	s := &Server{Handler: keepAliveHandler}
+
+	served := make(chan error)
+	go func() { served <- s.Serve(l) }()
+
+	conn, err := l.Dial()
+	require.NoError(t, err)
+	go conn.Write([]byte("GET /retried HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "you asked for /retried")
+
+	_, err = s.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+}
+
+func TestServerLimitsAndErrorHandler(t *testing.T) {
+	s := &Server{
+		Handler:        keepAliveHandler,
+		MaxHeaderBytes: 64,
+		MaxBodyBytes:   8,
+		ErrorHandler: func(w *response.Writer, req *request.Request, herr HandlerError) {
+			herr.Message = "custom: " + herr.Message
+			herr.Write(w)
+		},
+	}
+
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Padding: "+strings.Repeat("a", 100)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "custom: request header too large"), out)
+
+	out = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 20\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Payload Too Large\r\n"), out)
+
+	out = roundTrip(t, s, "NOPE / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	assert.True(t, strings.HasSuffix(out, "custom: bad request"), out)
+}
+
+func TestFormFilesRemovedAfterHandler(t *testing.T) {
+	dir := t.TempDir()
+	spilled := 0
+	s := &Server{Handler: func(w *response.Writer, r *request.Request) {
+		// parsed on a copy, as handlers behind middleware do
+		r = r.WithContext(context.Background())
+		_, err := r.ParseForm(request.FormOptions{MaxMemory: 1, TempDir: dir})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello", r.FormValue("name"))
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		spilled = len(files)
+		keepAliveHandler(w, r)
+	}}
+
+	body := "--b\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"big.bin\"\r\n\r\n" +
+		strings.Repeat("x", 100) + "\r\n--b--\r\n"
+	out := roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"+
+		"Content-Type: multipart/form-data; boundary=b\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+
+	assert.Equal(t, 1, spilled)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, files)
+}
+
+func TestHijack(t *testing.T) {
+	l := newMemListener()
+	states := make(chan ConnState, 16)
+	// errors seen by the handler are checked on the test goroutine
+	type hijackErrs struct{ hijack, again, write error }
+	errs := make(chan hijackErrs, 1)
+	s := &Server{
+		Handler: func(w *response.Writer, r *request.Request) {
+			conn, buffered, err := w.Hijack()
+			if err != nil {
+				errs <- hijackErrs{hijack: err}
+				return
+			}
+
+			_, _, again := w.Hijack()
+			_, write := w.WriteBody([]byte("too late"))
+			errs <- hijackErrs{again: again, write: write}
+
+			// speak a made-up protocol: echo what was pipelined, then
+			// whatever comes next, after the handler has returned
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("HIJACKED " + string(buffered) + "\n"))
+				rest := make([]byte, 4)
+				n, _ := io.ReadFull(conn, rest)
+				conn.Write(rest[:n])
+			}()
+		},
+		ConnState: func(_ net.Conn, state ConnState) {
+			states <- state
+		},
+	}
+	go s.Serve(l)
+
+	conn, err := l.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	go conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\nearly"))
+
+	handlerErrs := <-errs
+	require.NoError(t, handlerErrs.hijack)
+	assert.ErrorIs(t, handlerErrs.again, response.ErrorHijacked)
+	assert.ErrorIs(t, handlerErrs.write, response.ErrorHijacked)
+
+	// the server no longer tracks the connection, so Shutdown does not wait
+	dropped, err := s.Shutdown(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HIJACKED early\n", line)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(out))
+
+	close(states)
+	seen := []ConnState{}
+	for state := range states {
+		seen = append(seen, state)
+	}
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateHijacked}, seen)
+}
+
+func TestRequestContext(t *testing.T) {
+	tests := []struct {
+		name  string
+		end   func(s *Server, conn net.Conn)
+		cause error
+	}{
+		{
+			name:  "Client Disconnects",
+			end:   func(s *Server, conn net.Conn) { conn.Close() },
+			cause: ErrClientGone,
+		},
+		{
+			name:  "Server Closes",
+			end:   func(s *Server, conn net.Conn) { go s.Close() },
+			cause: ErrServerClosed,
+		},
+		{
+			name: "Shutdown Deadline Passes",
+			end: func(s *Server, conn net.Conn) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				go s.Shutdown(ctx)
+			},
+			cause: ErrServerClosed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entered := make(chan struct{})
+			causes := make(chan error, 1)
+			s, addr := startServer(t, func(w *response.Writer, r *request.Request) {
+				close(entered)
+				select {
+				case <-r.Context().Done():
+					causes <- context.Cause(r.Context())
+				case <-time.After(2 * time.Second):
+					causes <- nil
+				}
+			})
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			require.NoError(t, err)
+			<-entered
+
+			tc.end(s, conn)
+			assert.ErrorIs(t, <-causes, tc.cause)
+		})
+	}
+}
+
+func TestRequestContextWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := &Server{
+		WriteTimeout: 20 * time.Millisecond,
+		Handler: func(w *response.Writer, r *request.Request) {
+			<-r.Context().Done()
+			errs <- r.Context().Err()
+		},
+	}
+
+	roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+}
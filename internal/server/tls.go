@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type certFiles struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+}
+
+// CertStore holds the certificates the server presents and picks one per
+// connection by SNI. Certificates loaded from files can be reloaded at any
+// time; connections already established keep the certificate they got.
+type CertStore struct {
+	mu     sync.RWMutex
+	files  []certFiles
+	static []*tls.Certificate
+	loaded []*tls.Certificate
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{}
+}
+
+// AddFiles loads a PEM encoded certificate chain and key and remembers the
+// paths so Reload can pick up new versions
+func (cs *CertStore) AddFiles(certFile, keyFile string) error {
+	cert, err := loadCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.files = append(cs.files, certFiles{certFile: certFile, keyFile: keyFile, modTime: modTime(certFile, keyFile)})
+	cs.loaded = append(cs.loaded, cert)
+	return nil
+}
+
+// Add adds a certificate that lives only in memory
+func (cs *CertStore) Add(cert tls.Certificate) error {
+	if err := parseLeaf(&cert); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.static = append(cs.static, &cert)
+	return nil
+}
+
+// Reload reads every certificate file again. If any pair fails to load the
+// store keeps serving the certificates it already has.
+func (cs *CertStore) Reload() error {
+	cs.mu.RLock()
+	files := append([]certFiles(nil), cs.files...)
+	cs.mu.RUnlock()
+
+	loaded := make([]*tls.Certificate, 0, len(files))
+	for i, f := range files {
+		cert, err := loadCert(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, cert)
+		files[i].modTime = modTime(f.certFile, f.keyFile)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.files = files
+	cs.loaded = loaded
+	return nil
+}
+
+// GetCertificate chooses the certificate whose names match the SNI of the
+// handshake, falling back to the first certificate added. It is meant for
+// tls.Config.GetCertificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	certs := append(append([]*tls.Certificate(nil), cs.loaded...), cs.static...)
+	if len(certs) == 0 {
+		return nil, errors.New("tls: no certificates configured")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		for _, cert := range certs {
+			if cert.Leaf.VerifyHostname(name) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+// TLSConfig returns a config that serves the store's certificates. It
+// requires TLS 1.2 or later; callers may tighten MinVersion or restrict
+// CipherSuites on the result before handing it to a Server.
+func (cs *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cs.GetCertificate,
+	}
+}
+
+// ClientAuth selects whether clients must present a certificate
+type ClientAuth int
+
+const (
+	// ClientAuthNone does not ask for client certificates
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthOptional verifies a client certificate if one is sent
+	ClientAuthOptional
+	// ClientAuthRequired rejects handshakes without a valid client certificate
+	ClientAuthRequired
+)
+
+// SetClientAuth makes cfg verify client certificates against pool. The
+// verified chain ends up on request.Request.TLS for handlers to authorize by.
+func SetClientAuth(cfg *tls.Config, mode ClientAuth, pool *x509.CertPool) {
+	cfg.ClientCAs = pool
+	switch mode {
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		cfg.ClientAuth = tls.NoClientCert
+	}
+}
+
+// LoadCertPool reads PEM encoded CA certificates from files into a pool
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls: no certificates found in %s", name)
+		}
+	}
+	return pool, nil
+}
+
+// ReloadOnSignal reloads the certificates every time the process receives
+// SIGHUP, until ctx is done. Reload failures are passed to onError, which
+// may be nil.
+func (cs *CertStore) ReloadOnSignal(ctx context.Context, onError func(error)) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigChan:
+				if err := cs.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// ReloadOnChange polls the certificate files every interval and reloads
+// them when one has been modified, until ctx is done. Reload failures are
+// passed to onError, which may be nil.
+func (cs *CertStore) ReloadOnChange(ctx context.Context, interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !cs.changed() {
+					continue
+				}
+				if err := cs.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+func (cs *CertStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	for _, f := range cs.files {
+		if !modTime(f.certFile, f.keyFile).Equal(f.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: loading %s: %w", certFile, err)
+	}
+	if err := parseLeaf(&cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func parseLeaf(cert *tls.Certificate) error {
+	if cert.Leaf != nil {
+		return nil
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("tls: empty certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+// modTime is the later of the two files' modification times
+func modTime(certFile, keyFile string) time.Time {
+	latest := time.Time{}
+	for _, name := range []string{certFile, keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
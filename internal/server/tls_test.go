@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSigned returns PEM encoded certificate and key for the given names,
+// with the common name set to cn so tests can tell certificates apart
+func selfSigned(t *testing.T, cn string, names ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeCert(t *testing.T, dir, name string, certPEM, keyPEM []byte) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	return certFile, keyFile
+}
+
+// peerName dials addr over TLS with SNI and returns the common name of the
+// certificate the server presented
+func peerName(t *testing.T, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSServesBySNI(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCertStore()
+	certPEM, keyPEM := selfSigned(t, "cert-a", "a.example.com")
+	require.NoError(t, store.AddFiles(writeCert(t, dir, "a", certPEM, keyPEM)))
+	certPEM, keyPEM = selfSigned(t, "cert-b", "*.b.example.com")
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	require.NoError(t, store.Add(pair))
+
+	s := &Server{Handler: keepAliveHandler, TLSConfig: store.TLSConfig()}
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+	addr := l.Addr().String()
+
+	assert.Equal(t, "cert-a", peerName(t, addr, "a.example.com"))
+	assert.Equal(t, "cert-b", peerName(t, addr, "api.b.example.com"))
+	// unknown names get the first certificate
+	assert.Equal(t, "cert-a", peerName(t, addr, "unknown.example.com"))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /secure HTTP/1.1\r\nHost: a.example.com\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "you asked for /secure")
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	store := NewCertStore()
+	certPEM, keyPEM := selfSigned(t, "cert-a", "a.example.com")
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	require.NoError(t, store.Add(pair))
+
+	cfg := store.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS13
+	s := &Server{Handler: keepAliveHandler, TLSConfig: cfg}
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCertStore()
+	certPEM, keyPEM := selfSigned(t, "v1", "site.example.com")
+	certFile, keyFile := writeCert(t, dir, "site", certPEM, keyPEM)
+	require.NoError(t, store.AddFiles(certFile, keyFile))
+
+	s := &Server{Handler: keepAliveHandler, TLSConfig: store.TLSConfig()}
+	l, err := listenLoopback()
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+	addr := l.Addr().String()
+
+	// a connection made before the reload must survive it
+	before, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "site.example.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer before.Close()
+	assert.Equal(t, "v1", before.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store.ReloadOnChange(ctx, 10*time.Millisecond, nil)
+
+	certPEM, keyPEM = selfSigned(t, "v2", "site.example.com")
+	writeCert(t, dir, "site", certPEM, keyPEM)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+
+	assert.Eventually(t, func() bool {
+		return peerName(t, addr, "site.example.com") == "v2"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = before.Write([]byte("GET /still-here HTTP/1.1\r\nHost: site.example.com\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(before)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "you asked for /still-here")
+
+	// a broken file keeps the current certificate in place
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	assert.Error(t, store.Reload())
+	assert.Equal(t, "v2", peerName(t, addr, "site.example.com"))
+}
+
+// issueClientCert signs a client certificate for cn with the CA in caPEM/caKeyPEM
+func issueClientCert(t *testing.T, caPEM, caKeyPEM []byte, cn string) tls.Certificate {
+	ca, err := tls.X509KeyPair(caPEM, caKeyPEM)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"platform"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	caPEM, caKeyPEM := selfSigned(t, "internal-ca")
+	otherCAPEM, otherCAKeyPEM := selfSigned(t, "other-ca")
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(caPEM))
+
+	trusted := issueClientCert(t, caPEM, caKeyPEM, "billing-service")
+	untrusted := issueClientCert(t, otherCAPEM, otherCAKeyPEM, "intruder")
+
+	whoami := func(w *response.Writer, r *request.Request) {
+		body := "anonymous"
+		if subject, ok := r.ClientSubject(); ok {
+			body = subject.CommonName
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+
+	serve := func(mode ClientAuth) string {
+		store := NewCertStore()
+		certPEM, keyPEM := selfSigned(t, "server", "api.internal")
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		require.NoError(t, store.Add(pair))
+
+		cfg := store.TLSConfig()
+		SetClientAuth(cfg, mode, pool)
+		s := &Server{Handler: whoami, TLSConfig: cfg}
+		l, err := listenLoopback()
+		require.NoError(t, err)
+		go s.Serve(l)
+		t.Cleanup(func() { s.Close() })
+		return l.Addr().String()
+	}
+
+	get := func(addr string, certs ...tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: api.internal\r\n\r\n")); err != nil {
+			return "", err
+		}
+		out, err := io.ReadAll(conn)
+		return string(out), err
+	}
+
+	required := serve(ClientAuthRequired)
+	out, err := get(required, trusted)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "billing-service"), out)
+
+	out, err = get(required)
+	assert.True(t, err != nil || out == "", "request without a certificate was served: %q", out)
+	out, err = get(required, untrusted)
+	assert.True(t, err != nil || out == "", "request with an untrusted certificate was served: %q", out)
+
+	optional := serve(ClientAuthOptional)
+	out, err = get(optional)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "anonymous"), out)
+	out, err = get(optional, trusted)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "billing-service"), out)
+
+	none := serve(ClientAuthNone)
+	out, err = get(none, trusted)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "anonymous"), out)
+}
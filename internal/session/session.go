@@ -0,0 +1,389 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+const (
+	DefaultCookieName = "session"
+	DefaultMaxAge     = 24 * time.Hour
+)
+
+// MinKeyBytes is the shortest signing key accepted
+const MinKeyBytes = 32
+
+var ErrorInvalidKey = fmt.Errorf("invalid session key")
+var ErrorInvalidCookie = fmt.Errorf("invalid session cookie")
+
+type Options struct {
+	// Key signs session cookies. It must be at least MinKeyBytes long and
+	// kept secret; changing it logs everyone out.
+	Key []byte
+	// EncryptionKey, when set, also encrypts the ID inside the cookie with
+	// AES-GCM. It must be 16, 24 or 32 bytes.
+	EncryptionKey []byte
+	// Store defaults to a new MemoryStore
+	Store Store
+	// CookieName defaults to DefaultCookieName
+	CookieName string
+	// MaxAge is how long a session lives without being used. Each request
+	// that carries it starts the clock again. Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+	// Path defaults to "/"
+	Path   string
+	Domain string
+	Secure bool
+	// SameSite defaults to Lax
+	SameSite cookie.SameSite
+	// Logger reports store failures, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// Manager ties sessions to requests through a signed cookie that carries
+// nothing but a random ID; the data stays in the store.
+type Manager struct {
+	opts Options
+	aead cipher.AEAD
+	now  func() time.Time
+}
+
+func New(opts Options) (*Manager, error) {
+	if len(opts.Key) < MinKeyBytes {
+		return nil, fmt.Errorf("%w: signing key shorter than %d bytes", ErrorInvalidKey, MinKeyBytes)
+	}
+	m := &Manager{opts: opts, now: time.Now}
+	if opts.EncryptionKey != nil {
+		block, err := aes.NewCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrorInvalidKey, err)
+		}
+		m.aead, _ = cipher.NewGCM(block)
+	}
+	if m.opts.Store == nil {
+		m.opts.Store = NewMemoryStore()
+	}
+	if m.opts.CookieName == "" {
+		m.opts.CookieName = DefaultCookieName
+	}
+	if m.opts.MaxAge <= 0 {
+		m.opts.MaxAge = DefaultMaxAge
+	}
+	if m.opts.Path == "" {
+		m.opts.Path = "/"
+	}
+	if m.opts.SameSite == cookie.SameSiteDefault {
+		m.opts.SameSite = cookie.SameSiteLax
+	}
+	if m.opts.Logger == nil {
+		m.opts.Logger = slog.Default()
+	}
+	return m, nil
+}
+
+type contextKey struct{}
+
+// FromRequest returns the session the middleware attached to req, nil when
+// the request did not pass through it
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+// Middleware loads the session named by the request's cookie, or starts an
+// empty one, and makes it available through FromRequest. Changes are saved
+// and the cookie is sent just before the response headers are written. A
+// new session that is never written to is not stored and sets no cookie.
+//
+// An ID the server did not issue is never adopted, and RenewID gives the
+// session a new one; together they stop session fixation.
+func (m *Manager) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			s := m.load(req)
+			w.OnHeaders(func(status response.StatusCode, h *headers.Headers) {
+				m.commit(req.Context(), s, h)
+			})
+			next(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, s)))
+			// changes made after the headers went out are still stored
+			m.commit(req.Context(), s, nil)
+		}
+	}
+}
+
+func (m *Manager) load(req *request.Request) *Session {
+	s := &Session{values: map[string]string{}, isNew: true}
+	c, ok := req.Cookie(m.opts.CookieName)
+	if !ok {
+		return s
+	}
+	id, err := m.decode(c.Value)
+	if err != nil {
+		return s
+	}
+	r, err := m.opts.Store.Load(req.Context(), id)
+	if err != nil {
+		if !errors.Is(err, ErrorSessionNotFound) {
+			m.opts.Logger.Error("session load failed", "error", err)
+		}
+		return s
+	}
+	s.id = id
+	s.values = r.Values
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.flashes = r.Flashes
+	s.isNew = false
+	s.hadCookie = true
+	// every use slides the expiry forward
+	s.dirty = true
+	return s
+}
+
+// commit saves s and, when h is not nil, sets or clears the cookie in h.
+// Without h a session that still needs an ID is left alone, since the
+// cookie naming it could no longer reach the client.
+func (m *Manager) commit(ctx context.Context, s *Session, h *headers.Headers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.destroyed {
+		m.retire(ctx, s)
+		if h != nil && s.hadCookie {
+			m.setCookie(h, "", -1)
+			s.hadCookie = false
+		}
+		return
+	}
+	if !s.dirty || (s.id == "" && h == nil) {
+		return
+	}
+
+	if s.id == "" {
+		id, err := newID()
+		if err != nil {
+			m.opts.Logger.Error("session id failed", "error", err)
+			return
+		}
+		s.id = id
+	}
+	r := &Record{Values: s.values, Flashes: s.flashes, Expires: m.now().Add(m.opts.MaxAge)}
+	if err := m.opts.Store.Save(ctx, s.id, r); err != nil {
+		m.opts.Logger.Error("session save failed", "error", err)
+		return
+	}
+	s.dirty = false
+	m.retire(ctx, s)
+	if h == nil {
+		return
+	}
+	value, err := m.encode(s.id)
+	if err != nil {
+		m.opts.Logger.Error("session cookie failed", "error", err)
+		return
+	}
+	m.setCookie(h, value, int(m.opts.MaxAge/time.Second))
+	s.hadCookie = true
+}
+
+// retire deletes the ID s moved away from, if any
+func (m *Manager) retire(ctx context.Context, s *Session) {
+	if s.stale == "" {
+		return
+	}
+	if err := m.opts.Store.Delete(ctx, s.stale); err != nil {
+		m.opts.Logger.Error("session delete failed", "error", err)
+	}
+	s.stale = ""
+}
+
+func (m *Manager) setCookie(h *headers.Headers, value string, maxAge int) {
+	c := &cookie.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		MaxAge:   maxAge,
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+	if maxAge < 0 {
+		c.Expires = time.Unix(0, 0)
+	}
+	if err := cookie.SetCookie(h, c); err != nil {
+		m.opts.Logger.Error("session cookie failed", "error", err)
+	}
+}
+
+// encode turns an ID into a cookie value: the ID, encrypted when an
+// encryption key is set, followed by a dot and an HMAC-SHA256 signature
+// over the cookie name and that payload
+func (m *Manager) encode(id string) (string, error) {
+	payload := []byte(id)
+	if m.aead != nil {
+		nonce := make([]byte, m.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		payload = m.aead.Seal(nonce, nonce, payload, []byte(m.opts.CookieName))
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + m.sign(encoded), nil
+}
+
+func (m *Manager) decode(value string) (string, error) {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.sign(encoded))) {
+		return "", ErrorInvalidCookie
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrorInvalidCookie
+	}
+	if m.aead != nil {
+		n := m.aead.NonceSize()
+		if len(payload) < n {
+			return "", ErrorInvalidCookie
+		}
+		payload, err = m.aead.Open(nil, payload[:n], payload[n:], []byte(m.opts.CookieName))
+		if err != nil {
+			return "", ErrorInvalidCookie
+		}
+	}
+	return string(payload), nil
+}
+
+func (m *Manager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.opts.Key)
+	mac.Write([]byte(m.opts.CookieName + "|" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns 256 random bits
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Session is the data kept for one visitor. It is safe for concurrent use
+// within a request; concurrent requests for the same session each get
+// their own copy, and the last one to finish wins.
+type Session struct {
+	mu      sync.Mutex
+	id      string
+	values  map[string]string
+	flashes []string
+	// dirty marks changes that still need saving
+	dirty     bool
+	destroyed bool
+	// stale is an ID to delete from the store on the next commit
+	stale string
+	// hadCookie is set while the client holds a cookie for the session
+	hadCookie bool
+	isNew     bool
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.dirty = true
+	s.destroyed = false
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.dirty = true
+	}
+}
+
+// IsNew reports whether the session was started by this request
+func (s *Session) IsNew() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isNew
+}
+
+// AddFlash queues a message for the next request that reads Flashes,
+// typically the one after a redirect
+func (s *Session) AddFlash(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flashes = append(s.flashes, msg)
+	s.dirty = true
+	s.destroyed = false
+}
+
+// Flashes returns the queued messages and removes them
+func (s *Session) Flashes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes := s.flashes
+	if len(flashes) > 0 {
+		s.flashes = nil
+		s.dirty = true
+	}
+	return flashes
+}
+
+// RenewID moves the session to a fresh ID and retires the old one, keeping
+// the data. Call it whenever privileges change, above all right after
+// login, so an ID planted by an attacker before login is worthless. Like
+// any change that needs a cookie, it must happen before the response
+// headers are written.
+func (s *Session) RenewID() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id != "" {
+		s.stale = s.id
+		s.id = ""
+	}
+	s.dirty = true
+	s.destroyed = false
+}
+
+// Destroy deletes the session from the store and expires its cookie, as on
+// logout. Writing to it afterwards starts a new session under a new ID.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id != "" {
+		s.stale = s.id
+		s.id = ""
+	}
+	s.values = map[string]string{}
+	s.flashes = nil
+	s.dirty = false
+	s.destroyed = true
+}
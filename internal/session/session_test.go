@@ -0,0 +1,343 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/cookie"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func reply(w *response.Writer, body string) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// browser sends requests through a handler and keeps the session cookie
+// between them
+type browser struct {
+	t       *testing.T
+	h       server.Handler
+	cookie  string
+	lastSet *cookie.Cookie
+}
+
+func (b *browser) get(path string) string {
+	raw := "GET " + path + " HTTP/1.1\r\nHost: localhost\r\n"
+	if b.cookie != "" {
+		raw += "Cookie: " + b.cookie + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(b.t, err)
+
+	buf := &bufferCloser{}
+	b.h(response.NewWriter(buf), req)
+	res, err := response.ResponseFromReader(&buf.Buffer, "GET")
+	require.NoError(b.t, err)
+
+	b.lastSet = nil
+	for _, line := range res.Headers.Values("Set-Cookie") {
+		c, err := cookie.ParseSetCookie(line)
+		require.NoError(b.t, err)
+		b.lastSet = c
+		b.cookie = c.Name + "=" + c.Value
+		if c.MaxAge < 0 {
+			b.cookie = ""
+		}
+	}
+	body, err := io.ReadAll(res.Body)
+	require.NoError(b.t, err)
+	return string(body)
+}
+
+// app is a small site: /login stores the user and queues a flash message,
+// /whoami reports both and /logout ends the session
+func app(t *testing.T, m *Manager) *browser {
+	h := m.Middleware()(func(w *response.Writer, req *request.Request) {
+		s := FromRequest(req)
+		switch req.Path() {
+		case "/login":
+			s.RenewID()
+			s.Set("user", "ada")
+			s.AddFlash("welcome back")
+			reply(w, "ok")
+		case "/whoami":
+			user, _ := s.Get("user")
+			reply(w, fmt.Sprintf("user=%q new=%v flashes=%q", user, s.IsNew(), s.Flashes()))
+		case "/logout":
+			s.Destroy()
+			reply(w, "bye")
+		default:
+			reply(w, "nothing")
+		}
+	})
+	return &browser{t: t, h: h}
+}
+
+func newManager(t *testing.T, opts Options) *Manager {
+	if opts.Key == nil {
+		opts.Key = testKey
+	}
+	m, err := New(opts)
+	require.NoError(t, err)
+	return m
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	store := NewMemoryStore()
+	b := app(t, newManager(t, Options{Store: store}))
+
+	// nothing is stored for visitors who never write to their session
+	assert.Equal(t, `user="" new=true flashes=[]`, b.get("/whoami"))
+	assert.Nil(t, b.lastSet)
+	assert.Equal(t, 0, store.Len())
+
+	assert.Equal(t, "ok", b.get("/login"))
+	require.NotNil(t, b.lastSet)
+	assert.Equal(t, "session", b.lastSet.Name)
+	assert.Equal(t, "/", b.lastSet.Path)
+	assert.Equal(t, 86400, b.lastSet.MaxAge)
+	assert.True(t, b.lastSet.HttpOnly)
+	assert.Equal(t, cookie.SameSiteLax, b.lastSet.SameSite)
+	assert.Equal(t, 1, store.Len())
+
+	// the flash is shown once
+	assert.Equal(t, `user="ada" new=false flashes=["welcome back"]`, b.get("/whoami"))
+	assert.Equal(t, `user="ada" new=false flashes=[]`, b.get("/whoami"))
+
+	assert.Equal(t, "bye", b.get("/logout"))
+	require.NotNil(t, b.lastSet)
+	assert.Equal(t, -1, b.lastSet.MaxAge)
+	assert.Equal(t, 0, store.Len())
+	assert.Equal(t, `user="" new=true flashes=[]`, b.get("/whoami"))
+}
+
+func TestSessionFixation(t *testing.T) {
+	store := NewMemoryStore()
+	m := newManager(t, Options{Store: store})
+	attacker := app(t, m)
+	attacker.get("/login")
+	planted := attacker.cookie
+
+	// the victim logs in carrying the attacker's cookie and gets a new ID
+	victim := app(t, m)
+	victim.cookie = planted
+	victim.get("/login")
+	assert.NotEqual(t, planted, victim.cookie)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, `user="" new=true flashes=[]`, attacker.get("/whoami"))
+
+	// forged and unsigned IDs are not adopted
+	for _, forged := range []string{
+		"session=" + base64.RawURLEncoding.EncodeToString([]byte("chosen-id")),
+		"session=" + base64.RawURLEncoding.EncodeToString([]byte("chosen-id")) + ".c2lnbmF0dXJl",
+		"session=" + strings.Replace(victim.cookie, "session=", "", 1) + "x",
+	} {
+		b := app(t, m)
+		b.cookie = forged
+		assert.Equal(t, `user="" new=true flashes=[]`, b.get("/whoami"), forged)
+	}
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := NewMemoryStore()
+	store.now = clock
+	m := newManager(t, Options{Store: store, MaxAge: time.Hour})
+	m.now = clock
+	b := app(t, m)
+
+	b.get("/login")
+	b.get("/whoami")
+	for range 3 {
+		now = now.Add(50 * time.Minute)
+		assert.Equal(t, `user="ada" new=false flashes=[]`, b.get("/whoami"))
+		require.NotNil(t, b.lastSet)
+		assert.Equal(t, 3600, b.lastSet.MaxAge)
+	}
+
+	now = now.Add(61 * time.Minute)
+	assert.Equal(t, `user="" new=true flashes=[]`, b.get("/whoami"))
+}
+
+func TestEncryptedIDs(t *testing.T) {
+	store := NewMemoryStore()
+	m := newManager(t, Options{Store: store, EncryptionKey: []byte("fedcba9876543210")})
+	b := app(t, m)
+	b.get("/login")
+	assert.Equal(t, `user="ada" new=false flashes=["welcome back"]`, b.get("/whoami"))
+
+	var id string
+	for k := range store.records {
+		id = k
+	}
+	value := strings.TrimPrefix(b.cookie, "session=")
+	payload, _, _ := strings.Cut(value, ".")
+	assert.NotContains(t, value, id)
+	assert.NotEqual(t, base64.RawURLEncoding.EncodeToString([]byte(id)), payload)
+
+	// the same ID encrypts differently each time and still decodes
+	again, err := m.encode(id)
+	require.NoError(t, err)
+	assert.NotEqual(t, value, again)
+	decoded, err := m.decode(again)
+	require.NoError(t, err)
+	assert.Equal(t, id, decoded)
+
+	// without the encryption key the ID cannot be recovered
+	plain := newManager(t, Options{Store: store})
+	decoded, err = plain.decode(again)
+	require.NoError(t, err)
+	assert.NotEqual(t, id, decoded)
+	other := newManager(t, Options{Store: store, EncryptionKey: []byte("0000000000000000")})
+	_, err = other.decode(again)
+	assert.ErrorIs(t, err, ErrorInvalidCookie)
+}
+
+func TestNewValidatesKeys(t *testing.T) {
+	_, err := New(Options{Key: []byte("short")})
+	assert.ErrorIs(t, err, ErrorInvalidKey)
+	_, err = New(Options{Key: testKey, EncryptionKey: []byte("not an aes key")})
+	assert.ErrorIs(t, err, ErrorInvalidKey)
+}
+
+// stubStore is a Store standing in for an external one
+type stubStore struct {
+	records map[string]*Record
+	calls   []string
+	err     error
+}
+
+func (s *stubStore) Load(ctx context.Context, id string) (*Record, error) {
+	s.calls = append(s.calls, "load")
+	if s.err != nil {
+		return nil, s.err
+	}
+	r, ok := s.records[id]
+	if !ok {
+		return nil, ErrorSessionNotFound
+	}
+	return r, nil
+}
+
+func (s *stubStore) Save(ctx context.Context, id string, r *Record) error {
+	s.calls = append(s.calls, "save")
+	if s.err != nil {
+		return s.err
+	}
+	s.records[id] = r
+	return nil
+}
+
+func (s *stubStore) Delete(ctx context.Context, id string) error {
+	s.calls = append(s.calls, "delete")
+	delete(s.records, id)
+	return s.err
+}
+
+func TestExternalStore(t *testing.T) {
+	var logs bytes.Buffer
+	store := &stubStore{records: map[string]*Record{}}
+	b := app(t, newManager(t, Options{Store: store, Logger: slog.New(slog.NewTextHandler(&logs, nil))}))
+
+	b.get("/login")
+	b.get("/whoami")
+	b.get("/logout")
+	assert.Equal(t, []string{"save", "load", "save", "load", "delete"}, store.calls)
+	assert.Empty(t, store.records)
+
+	// a failing store still lets the request through
+	store.err = fmt.Errorf("connection refused")
+	b.get("/login")
+	assert.Equal(t, "nothing", b.get("/"))
+	assert.Contains(t, logs.String(), "session save failed")
+	assert.Contains(t, logs.String(), "connection refused")
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	_, err = store.Load(ctx, "missing")
+	assert.ErrorIs(t, err, ErrorSessionNotFound)
+
+	r := &Record{Values: map[string]string{"user": "ada"}, Flashes: []string{"hi"}, Expires: now.Add(time.Hour)}
+	require.NoError(t, store.Save(ctx, "../../etc/passwd", r))
+	require.NoError(t, store.Save(ctx, "short-lived", &Record{Expires: now.Add(time.Minute)}))
+
+	// records survive a restart
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	reopened.now = store.now
+	loaded, err := reopened.Load(ctx, "../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, r.Values, loaded.Values)
+	assert.Equal(t, r.Flashes, loaded.Flashes)
+
+	now = now.Add(2 * time.Minute)
+	_, err = reopened.Load(ctx, "short-lived")
+	assert.ErrorIs(t, err, ErrorSessionNotFound)
+
+	require.NoError(t, reopened.Delete(ctx, "../../etc/passwd"))
+	require.NoError(t, reopened.Delete(ctx, "../../etc/passwd"))
+	_, err = reopened.Load(ctx, "../../etc/passwd")
+	assert.ErrorIs(t, err, ErrorSessionNotFound)
+}
+
+func TestFileStoreSweeps(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	for i := range 3 {
+		require.NoError(t, store.Save(ctx, fmt.Sprint("old", i), &Record{Expires: now.Add(time.Minute)}))
+	}
+	now = now.Add(time.Hour)
+	require.NoError(t, store.Save(ctx, "fresh", &Record{Expires: now.Add(time.Hour)}))
+
+	entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMemoryStoreCopies(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	r := &Record{Values: map[string]string{"a": "1"}, Expires: time.Now().Add(time.Hour)}
+	require.NoError(t, store.Save(ctx, "id", r))
+	r.Values["a"] = "changed"
+
+	loaded, err := store.Load(ctx, "id")
+	require.NoError(t, err)
+	assert.Equal(t, "1", loaded.Values["a"])
+}
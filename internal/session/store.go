@@ -0,0 +1,217 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorSessionNotFound = fmt.Errorf("session not found")
+
+// sweepInterval is how often the built-in stores look for expired
+// sessions to drop
+const sweepInterval = time.Minute
+
+// Record is what a store keeps for a session
+type Record struct {
+	Values  map[string]string `json:"values"`
+	Flashes []string          `json:"flashes,omitempty"`
+	// Expires is when the record stops being valid. Every request that
+	// uses the session pushes it back.
+	Expires time.Time `json:"expires"`
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !r.Expires.After(now)
+}
+
+// Store keeps session records by ID. Load returns ErrorSessionNotFound for
+// IDs it does not know or whose record has expired. Implementations must
+// be safe for concurrent use; external stores such as a database only
+// need these three methods.
+type Store interface {
+	Load(ctx context.Context, id string) (*Record, error)
+	Save(ctx context.Context, id string, r *Record) error
+	Delete(ctx context.Context, id string) error
+}
+
+// MemoryStore keeps records in memory until they expire. It is lost when
+// the process exits.
+type MemoryStore struct {
+	mu        sync.Mutex
+	records   map[string]*Record
+	lastSweep time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*Record{}, now: time.Now}
+}
+
+func (m *MemoryStore) Load(ctx context.Context, id string) (*Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.records[id]
+	if !ok || r.expired(m.now()) {
+		delete(m.records, id)
+		return nil, ErrorSessionNotFound
+	}
+	return copyRecord(r), nil
+}
+
+func (m *MemoryStore) Save(ctx context.Context, id string, r *Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.lastSweep = now
+		for id, r := range m.records {
+			if r.expired(now) {
+				delete(m.records, id)
+			}
+		}
+	}
+	m.records[id] = copyRecord(r)
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, id)
+	return nil
+}
+
+// Len returns the number of records held, expired ones included until
+// they are swept
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.records)
+}
+
+func copyRecord(r *Record) *Record {
+	c := &Record{Values: make(map[string]string, len(r.Values)), Expires: r.Expires}
+	for k, v := range r.Values {
+		c.Values[k] = v
+	}
+	c.Flashes = append([]string{}, r.Flashes...)
+	return c
+}
+
+// FileStore keeps each record as a JSON file in a directory, so sessions
+// survive restarts. File names are hashes of the IDs, which keeps IDs out
+// of directory listings and out of paths.
+type FileStore struct {
+	dir       string
+	mu        sync.Mutex
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewFileStore returns a store writing to dir, which is created if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, now: time.Now}, nil
+}
+
+func (f *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (f *FileStore) Load(ctx context.Context, id string) (*Record, error) {
+	data, err := os.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrorSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &Record{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("session file: %w", err)
+	}
+	if r.expired(f.now()) {
+		os.Remove(f.path(id))
+		return nil, ErrorSessionNotFound
+	}
+	return r, nil
+}
+
+// Save writes the record to a temporary file and renames it into place,
+// so a concurrent Load never sees half a record
+func (f *FileStore) Save(ctx context.Context, id string, r *Record) error {
+	f.sweep()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path(id)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) Delete(ctx context.Context, id string) error {
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// sweep removes expired records at most once per sweepInterval
+func (f *FileStore) sweep() {
+	f.mu.Lock()
+	now := f.now()
+	if now.Sub(f.lastSweep) < sweepInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastSweep = now
+	f.mu.Unlock()
+
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(f.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		r := &Record{}
+		if json.Unmarshal(data, r) == nil && r.expired(now) {
+			os.Remove(path)
+		}
+	}
+}
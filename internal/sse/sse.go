@@ -0,0 +1,200 @@
+package sse
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+)
+
+const DefaultHeartbeatInterval = 15 * time.Second
+
+var ErrorInvalidField = fmt.Errorf("sse: field contains a line break")
+var ErrorClosed = fmt.Errorf("sse: stream closed")
+
+// Event is a single message on the stream. Empty fields are left out.
+type Event struct {
+	ID    string
+	Event string
+	// Data may span several lines; each becomes its own data field
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// Stream sends events to one client. It is safe for concurrent use, so a
+// heartbeat can run alongside the handler.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	err    error
+	done   chan struct{}
+	closed bool
+}
+
+// Start answers req with a text/event-stream response. The body is sent
+// chunked, one chunk per event.
+func Start(w *response.Writer, req *request.Request) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	// ask buffering proxies to pass events straight through
+	h.Set("X-Accel-Buffering", "no")
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	s := &Stream{
+		w:           w,
+		lastEventID: lastEventID,
+		done:        make(chan struct{}),
+	}
+
+	// the request context ends when the client disconnects
+	ctx := req.Context()
+	go func() {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.end(context.Cause(ctx))
+			s.mu.Unlock()
+		}
+	}()
+	return s, nil
+}
+
+// LastEventID returns the id of the last event a reconnecting client saw,
+// or "" on a first connection
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the client has gone away or the stream was closed.
+// Handlers should stop producing events when it is.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error that ended the stream, if any
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send writes e as one chunk
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrorInvalidField
+	}
+
+	b := []byte{}
+	if e.ID != "" {
+		b = fmt.Appendf(b, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		b = fmt.Appendf(b, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		b = fmt.Appendf(b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	if e.Data != "" {
+		data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b = fmt.Appendf(b, "data: %s\n", line)
+		}
+	}
+	b = append(b, '\n')
+	return s.write(b)
+}
+
+// Comment writes a comment line, which clients ignore. It keeps idle
+// connections open through proxies and reveals clients that have left.
+func (s *Stream) Comment(text string) error {
+	b := []byte{}
+	for _, line := range strings.Split(text, "\n") {
+		b = fmt.Appendf(b, ": %s\n", line)
+	}
+	b = append(b, '\n')
+	return s.write(b)
+}
+
+// Heartbeat sends a comment every interval until the stream is done.
+// DefaultHeartbeatInterval is used when interval is zero.
+func (s *Stream) Heartbeat(interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.Comment("heartbeat")
+			}
+		}
+	}()
+}
+
+// Close ends the response and stops the heartbeat. It is safe to call
+// more than once, and after the client has gone away.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.end(nil)
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.Finish()
+}
+
+func (s *Stream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		if s.err != nil {
+			return s.err
+		}
+		return ErrorClosed
+	}
+	if _, err := s.w.WriteChunkedBody(b); err != nil {
+		// the client is gone; nothing more can be sent
+		s.end(err)
+		return err
+	}
+	return nil
+}
+
+// end marks the stream finished, with err when the client went away. The
+// caller holds s.mu.
+func (s *Stream) end(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+}
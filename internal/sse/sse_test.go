@@ -0,0 +1,145 @@
+package sse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientConn records what reaches the client and fails writes once the
+// client has hung up
+type clientConn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	hungUp bool
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hungUp {
+		return 0, errors.New("broken pipe")
+	}
+	return c.buf.Write(p)
+}
+
+func (c *clientConn) Close() error { return nil }
+
+func (c *clientConn) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+func (c *clientConn) hangUp() {
+	c.mu.Lock()
+	c.hungUp = true
+	c.mu.Unlock()
+}
+
+func start(t *testing.T, rawRequest string) (*Stream, *clientConn) {
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	conn := &clientConn{}
+	s, err := Start(response.NewWriter(conn), req)
+	require.NoError(t, err)
+	return s, conn
+}
+
+func TestSendFormatsEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		chunk string
+	}{
+		{
+			name:  "Data Only",
+			event: Event{Data: "hello"},
+			chunk: "data: hello\n\n",
+		},
+		{
+			name:  "All Fields",
+			event: Event{ID: "42", Event: "update", Data: "x", Retry: 3 * time.Second},
+			chunk: "id: 42\nevent: update\nretry: 3000\ndata: x\n\n",
+		},
+		{
+			name:  "Multi-line Data",
+			event: Event{Data: "one\ntwo\r\nthree"},
+			chunk: "data: one\ndata: two\ndata: three\n\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, conn := start(t, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			require.NoError(t, s.Send(tc.event))
+			require.NoError(t, s.Close())
+
+			out := conn.String()
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+			assert.Contains(t, out, "content-type: text/event-stream\r\n")
+			assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+			_, body, _ := strings.Cut(out, "\r\n\r\n")
+			assert.Contains(t, body, tc.chunk)
+			assert.True(t, strings.HasSuffix(body, "0\r\n\r\n"), body)
+		})
+	}
+}
+
+func TestSendRejectsLineBreaksInFields(t *testing.T) {
+	s, _ := start(t, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.ErrorIs(t, s.Send(Event{ID: "1\n2", Data: "x"}), ErrorInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb", Data: "x"}), ErrorInvalidField)
+}
+
+func TestLastEventID(t *testing.T) {
+	s, _ := start(t, "GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 17\r\n\r\n")
+	assert.Equal(t, "17", s.LastEventID())
+}
+
+func TestHeartbeatNoticesDisconnect(t *testing.T) {
+	s, conn := start(t, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	s.Heartbeat(10 * time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(conn.String(), ": heartbeat\n\n")
+	}, time.Second, 5*time.Millisecond)
+
+	conn.hangUp()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream did not notice the client leaving")
+	}
+	assert.Error(t, s.Err())
+	assert.Error(t, s.Send(Event{Data: "too late"}))
+	assert.NoError(t, s.Close())
+}
+
+func TestContextCancellationEndsStream(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	gone := errors.New("client went away")
+
+	s, err := Start(response.NewWriter(&clientConn{}), req.WithContext(ctx))
+	require.NoError(t, err)
+	cancel(gone)
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream did not end with its context")
+	}
+	assert.ErrorIs(t, s.Err(), gone)
+	assert.ErrorIs(t, s.Send(Event{Data: "too late"}), gone)
+}
@@ -0,0 +1,410 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+func (op opcode) control() bool {
+	return op&0x8 != 0
+}
+
+// Close codes from RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// closeTimeout is how long Close waits for the peer to answer a close frame
+const closeTimeout = 5 * time.Second
+
+var ErrorClosed = fmt.Errorf("websocket: connection closed")
+var ErrorProtocol = fmt.Errorf("websocket: protocol error")
+var ErrorMessageTooLarge = fmt.Errorf("websocket: message too large")
+var ErrorInvalidUTF8 = fmt.Errorf("websocket: invalid utf-8 in text")
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed by peer: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write; writes are serialized.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	server         bool
+	subprotocol    string
+	maxMessageSize int
+	fragmentSize   int
+
+	readMu        sync.Mutex
+	closeReceived bool
+	peerClosed    chan struct{}
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// newConn wraps conn. buffered holds bytes already read from it. A server
+// conn expects masked frames and sends unmasked ones; a client the reverse.
+func newConn(conn net.Conn, buffered []byte, server bool, opts Options) *Conn {
+	if opts.MaxMessageSize == 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return &Conn{
+		conn:           conn,
+		reader:         bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		server:         server,
+		maxMessageSize: opts.MaxMessageSize,
+		fragmentSize:   opts.FragmentSize,
+		peerClosed:     make(chan struct{}),
+	}
+}
+
+// Subprotocol returns the subprotocol selected during the handshake
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline bounds the wait for the next frame
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message, reassembled from
+// its fragments. Pings are answered and pongs dropped along the way. After
+// the peer closes the connection it returns a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.readMessage()
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	if c.closeReceived {
+		return 0, nil, ErrorClosed
+	}
+
+	var typ MessageType
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame(c.maxMessageSize - len(msg))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload, true); err != nil && !errors.Is(err, ErrorClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opContinuation:
+			if typ == 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "continuation without a message")
+			}
+		case opText, opBinary:
+			if typ != 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "new message inside a fragmented one")
+			}
+			typ = MessageType(op)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "unknown opcode")
+		}
+
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if typ == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, ErrorInvalidUTF8, "invalid utf-8")
+		}
+		return typ, msg, nil
+	}
+}
+
+// readFrame reads a single frame whose payload may be at most limit bytes
+// if it carries data
+func (c *Conn) readFrame(limit int) (bool, opcode, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	op := opcode(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "reserved bits set")
+	}
+	if masked != c.server {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "bad masking")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if op.control() {
+		if !fin || length > 125 {
+			return false, 0, nil, c.fail(CloseProtocolError, ErrorProtocol, "bad control frame")
+		}
+	} else if length > uint64(limit) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, ErrorMessageTooLarge, "message too large")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, key[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		mask(payload, key)
+	}
+	return fin, op, payload, nil
+}
+
+// handleClose answers the peer's close frame and closes the connection
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, ErrorProtocol, "bad close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, ErrorProtocol, "bad close code")
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, ErrorInvalidUTF8, "invalid utf-8")
+		}
+	}
+
+	c.closeReceived = true
+	close(c.peerClosed)
+
+	echo := []byte{}
+	if closeErr.Code != CloseNoStatus {
+		echo = binary.BigEndian.AppendUint16(echo, uint16(closeErr.Code))
+	}
+	c.writeFrame(opClose, echo, true)
+	c.conn.Close()
+	return closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the connection with code after a protocol violation
+func (c *Conn) fail(code int, err error, reason string) error {
+	c.writeFrame(opClose, closePayload(code, reason), true)
+	c.conn.Close()
+	return fmt.Errorf("%w: %s", err, reason)
+}
+
+// WriteMessage sends data as a single message, split into fragments when
+// FragmentSize is set
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("websocket: bad message type %d", typ)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	op := opcode(typ)
+	for {
+		n := len(data)
+		if c.fragmentSize > 0 {
+			n = min(n, c.fragmentSize)
+		}
+		fin := n == len(data)
+		if err := c.writeFrameLocked(op, data[:n], fin); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[n:]
+		op = opContinuation
+	}
+}
+
+// Ping sends a ping; the peer's pong is consumed by ReadMessage
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return fmt.Errorf("websocket: ping payload too long")
+	}
+	return c.writeFrame(opPing, data, true)
+}
+
+// Close starts the closing handshake: it sends a close frame, waits a
+// little for the peer's answer and closes the connection. A concurrent
+// ReadMessage sees the answer and returns a *CloseError.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeFrame(opClose, closePayload(code, reason), true)
+	if errors.Is(err, ErrorClosed) {
+		err = nil
+	}
+
+	if c.readMu.TryLock() {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for !c.closeReceived {
+			// anything the peer sends before its close frame is dropped
+			if _, _, rerr := c.readMessage(); rerr != nil {
+				var closeErr *CloseError
+				if !errors.As(rerr, &closeErr) {
+					break
+				}
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		select {
+		case <-c.peerClosed:
+		case <-time.After(closeTimeout):
+		}
+	}
+
+	c.conn.Close()
+	return err
+}
+
+func closePayload(code int, reason string) []byte {
+	p := binary.BigEndian.AppendUint16(nil, uint16(code))
+	p = append(p, reason...)
+	return p[:min(len(p), 125)]
+}
+
+func (c *Conn) writeFrame(op opcode, payload []byte, fin bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(op, payload, fin)
+}
+
+// writeFrameLocked sends one frame. Nothing may follow a close frame.
+func (c *Conn) writeFrameLocked(op opcode, payload []byte, fin bool) error {
+	if c.closeSent {
+		return ErrorClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+
+	maskBit := byte(0)
+	if !c.server {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.server {
+		frame = append(frame, payload...)
+	} else {
+		// clients mask every frame with a fresh key
+		var key [4]byte
+		rand.Read(key[:])
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		mask(frame[start:], key)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/headers"
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+)
+
+// acceptGUID is the fixed suffix RFC 6455 mixes into Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const DefaultMaxMessageSize = 1 << 20
+
+var ErrorBadHandshake = fmt.Errorf("websocket: bad handshake")
+var ErrorOriginNotAllowed = fmt.Errorf("websocket: origin not allowed")
+
+type Options struct {
+	// Subprotocols lists the subprotocols the server speaks, most
+	// preferred first. The first one the client also offers is selected.
+	Subprotocols []string
+	// CheckOrigin decides whether to accept the handshake. When nil, a
+	// request carrying an Origin header is only accepted if the origin's
+	// host matches the Host header.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize limits a reassembled message, DefaultMaxMessageSize
+	// when zero
+	MaxMessageSize int
+	// FragmentSize splits outgoing messages into frames of at most this
+	// many bytes. Zero sends every message as a single frame.
+	FragmentSize int
+}
+
+// Upgrade performs the server side of the opening handshake and takes over
+// the connection. When the request is not a valid WebSocket handshake, an
+// error response is written and an error returned; the handler should then
+// simply return.
+func Upgrade(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if req.RequestLine.Method != "GET" ||
+		req.RequestLine.HttpVersion != "1.1" ||
+		!req.Headers.HasToken("Connection", "upgrade") ||
+		!req.Headers.HasToken("Upgrade", "websocket") {
+		server.HandlerError{StatusCode: response.StatusBadRequest, Message: "not a websocket handshake"}.Write(w)
+		return nil, ErrorBadHandshake
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Sec-WebSocket-Version", "13")
+		w.WriteStatusLine(response.StatusUpgradeRequired)
+		w.WriteHeaders(*h)
+		return nil, ErrorBadHandshake
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	if !validKey(key) {
+		server.HandlerError{StatusCode: response.StatusBadRequest, Message: "bad Sec-WebSocket-Key"}.Write(w)
+		return nil, ErrorBadHandshake
+	}
+
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		server.HandlerError{StatusCode: response.StatusForbidden, Message: "origin not allowed"}.Write(w)
+		return nil, ErrorOriginNotAllowed
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		server.HandlerError{StatusCode: response.StatusBadRequest, Message: "websocket needs HTTP/1.1"}.Write(w)
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	subprotocol := selectSubprotocol(req.Headers, opts.Subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	// the writer we were given belongs to the server, which is done with
+	// the connection now
+	hw := response.NewWriter(conn)
+	hw.WriteStatusLine(response.StatusSwitchingProtocols)
+	if err := hw.WriteHeaders(*h); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := newConn(conn, buffered, true, opts)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// acceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validKey reports whether key is the base64 encoding of 16 bytes
+func validKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+func selectSubprotocol(h *headers.Headers, supported []string) string {
+	value, _ := h.Get("Sec-WebSocket-Protocol")
+	offered := []string{}
+	for _, p := range strings.Split(value, ",") {
+		offered = append(offered, strings.TrimSpace(p))
+	}
+	for _, p := range supported {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get("Origin")
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := req.Headers.Get("Host")
+	return strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,222 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AmiyoKm/httpfromtcp/internal/request"
+	"github.com/AmiyoKm/httpfromtcp/internal/response"
+	"github.com/AmiyoKm/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /ws HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+// startEcho serves an echo endpoint and reports the error that ended each
+// connection on errs
+func startEcho(t *testing.T, opts Options) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	s := &server.Server{Handler: func(w *response.Writer, req *request.Request) {
+		c, err := Upgrade(w, req, opts)
+		if err != nil {
+			return
+		}
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			c.WriteMessage(typ, msg)
+		}
+	}}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String(), errs
+}
+
+// dial performs the client side of the handshake with extra header lines
+func dial(t *testing.T, addr, extra string) (*Conn, string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write([]byte(handshake + extra + "\r\n"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	head := ""
+	for !strings.HasSuffix(head, "\r\n\r\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+	}
+	buffered, _ := br.Peek(br.Buffered())
+	return newConn(conn, buffered, false, Options{}), head
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	addr, _ := startEcho(t, Options{})
+
+	tests := []struct {
+		name    string
+		request string
+		status  string
+		header  string
+	}{
+		{
+			name:    "Not An Upgrade",
+			request: "GET /ws HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:    "Unsupported Version",
+			request: strings.Replace(handshake, "Version: 13", "Version: 8", 1) + "\r\n",
+			status:  "HTTP/1.1 426 Upgrade Required",
+			header:  "sec-websocket-version: 13",
+		},
+		{
+			name:    "Bad Key",
+			request: strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1) + "\r\n",
+			status:  "HTTP/1.1 400 Bad Request",
+		},
+		{
+			name:    "Cross Origin",
+			request: handshake + "Origin: http://evil.example.com\r\n\r\n",
+			status:  "HTTP/1.1 403 Forbidden",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			_, err = conn.Write([]byte(tc.request))
+			require.NoError(t, err)
+			out, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(out), tc.status+"\r\n"), string(out))
+			assert.Contains(t, string(out), tc.header)
+		})
+	}
+}
+
+func TestEchoMessages(t *testing.T) {
+	addr, _ := startEcho(t, Options{Subprotocols: []string{"chat.v2", "chat.v1"}})
+	c, head := dial(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n")
+
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"), head)
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat.v2\r\n")
+
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	typ, msg, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "hello", string(msg))
+
+	// a fragmented message comes back whole
+	c.fragmentSize = 3
+	payload := []byte(strings.Repeat("0123456789", 30))
+	require.NoError(t, c.WriteMessage(BinaryMessage, payload))
+	typ, msg, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, typ)
+	assert.Equal(t, payload, msg)
+}
+
+func TestPingIsAnswered(t *testing.T) {
+	addr, _ := startEcho(t, Options{})
+	c, _ := dial(t, addr, "")
+
+	require.NoError(t, c.Ping([]byte("are you there")))
+	fin, op, payload, err := c.readFrame(0)
+	require.NoError(t, err)
+	assert.True(t, fin)
+	assert.Equal(t, opPong, op)
+	assert.Equal(t, "are you there", string(payload))
+}
+
+func TestCloseHandshake(t *testing.T) {
+	addr, errs := startEcho(t, Options{})
+	c, _ := dial(t, addr, "")
+
+	require.NoError(t, c.Close(CloseNormalClosure, "bye"))
+
+	var closeErr *CloseError
+	require.ErrorAs(t, <-errs, &closeErr)
+	assert.Equal(t, CloseNormalClosure, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+	assert.True(t, c.closeReceived)
+}
+
+func TestProtocolViolationsClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		frame []byte
+		code  int
+	}{
+		{
+			name:  "Unmasked Frame",
+			frame: []byte{0x81, 0x02, 'h', 'i'},
+			code:  CloseProtocolError,
+		},
+		{
+			name:  "Fragmented Ping",
+			frame: []byte{0x09, 0x80, 0, 0, 0, 0},
+			code:  CloseProtocolError,
+		},
+		{
+			name:  "Message Too Big",
+			opts:  Options{MaxMessageSize: 4},
+			frame: []byte{0x82, 0x85, 0, 0, 0, 0, 1, 2, 3, 4, 5},
+			code:  CloseMessageTooBig,
+		},
+		{
+			name:  "Invalid UTF-8",
+			frame: []byte{0x81, 0x82, 0, 0, 0, 0, 0xc3, 0x28},
+			code:  CloseInvalidPayload,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, errs := startEcho(t, tc.opts)
+			c, _ := dial(t, addr, "")
+
+			_, err := c.conn.Write(tc.frame)
+			require.NoError(t, err)
+
+			_, op, payload, err := c.readFrame(0)
+			require.NoError(t, err)
+			assert.Equal(t, opClose, op)
+			require.GreaterOrEqual(t, len(payload), 2)
+			assert.Equal(t, tc.code, int(binary.BigEndian.Uint16(payload)))
+			assert.Error(t, <-errs)
+		})
+	}
+}